@@ -12,17 +12,21 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/docker/go-events"
 	"github.com/factorysh/microdensity/badge"
 	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/metrics"
 	"github.com/factorysh/microdensity/middlewares/jwt"
 	jwtoroauth2 "github.com/factorysh/microdensity/middlewares/jwt_or_oauth2"
 	"github.com/factorysh/microdensity/oauth"
 	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/ratelimit"
 	"github.com/factorysh/microdensity/run"
+	"github.com/factorysh/microdensity/schedule"
 	"github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/sessions"
 	"github.com/factorysh/microdensity/storage"
@@ -31,6 +35,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tchap/zapext/v2/zapsentry"
 	"go.uber.org/zap"
@@ -38,6 +43,9 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
+// journalFile is the queue journal, in the data path
+const journalFile = "queue.journal"
+
 type Application struct {
 	Services      map[string]service.Service
 	serviceFolder string
@@ -54,6 +62,17 @@ type Application struct {
 	AdminServer   *http.Server
 	PruneLock     semaphore.Weighted
 	Stopper       chan (os.Signal)
+	priority      conf.PriorityRules
+	scheduler     *schedule.Scheduler
+	retryAfter    time.Duration
+	rateLimit     conf.RateLimitConf
+	limiter       *ratelimit.Limiter
+	suites        conf.Suites
+	drainTimeout  time.Duration
+	workerTokens  map[string]string
+	workers       map[string]*WorkerInfo
+	workersLock   sync.Mutex
+	stopLeases    context.CancelFunc
 }
 
 func New(cfg *conf.Conf) (*Application, error) {
@@ -116,18 +135,31 @@ func New(cfg *conf.Conf) (*Application, error) {
 		logger.Error("Services crash", zap.Error(err))
 		return nil, err
 	}
+	err = validateSuites(cfg.Suites, svcs)
+	if err != nil {
+		logger.Error("Suites crash", zap.Error(err))
+		return nil, err
+	}
 	logger.Info("Load services",
 		zap.String("service path", cfg.Services),
 		zap.Any("services", svcs))
 
+	metrics.SetProjectLabels(cfg.Metrics.ProjectLabels)
 	runner, err := run.NewRunner(cfg.Services, cfg.DataPath, cfg.Hosts)
 	if err != nil {
 		logger.Error("Runner crash", zap.Error(err))
 		return nil, err
 	}
 
+	journal, err := queue.OpenJournal(filepath.Join(cfg.DataPath, journalFile))
+	if err != nil {
+		logger.Error("Queue journal crash", zap.Error(err))
+		return nil, err
+	}
+
 	_sink := events.NewBroadcaster()
-	q := queue.NewQueue(s, runner, _sink)
+	q := queue.NewQueue(s, runner, _sink, svcs, cfg)
+	q.Journal = journal
 
 	r := chi.NewRouter()
 
@@ -146,10 +178,33 @@ func New(cfg *conf.Conf) (*Application, error) {
 		queue:         &q,
 		Sink:          _sink,
 		Stopper:       make(chan os.Signal, 1),
+		priority:      cfg.Priority.PriorityRules,
+		retryAfter:    cfg.MaintenanceRetryAfter,
+		rateLimit:     cfg.RateLimit,
+		limiter:       ratelimit.New(),
+		suites:        cfg.Suites,
+		drainTimeout:  cfg.ShutdownTimeout,
+		workerTokens:  cfg.Workers.Tokens,
+		workers:       make(map[string]*WorkerInfo),
 	}
 	ar.Get("/status", a.StatusHandler)
 	ar.Get("/sink", a.SinkAllHandler)
+	ar.Get("/queue", a.AdminQueueHandler)
+	ar.Get("/queue/state", a.AdminQueueStateHandler)
+	ar.Post("/queue/pause", a.AdminQueuePauseHandler)
+	ar.Post("/queue/resume", a.AdminQueueResumeHandler)
+	ar.Post("/queue/drain", a.AdminQueueDrainHandler)
+	ar.Post("/maintenance", a.AdminMaintenanceHandler)
+	ar.Delete("/maintenance", a.AdminDeleteMaintenanceHandler)
 	ar.Post("/prune", a.PruneHandler)
+
+	a.scheduler, err = schedule.New(filepath.Join(cfg.DataPath, schedulesDir), a.runSchedule)
+	if err != nil {
+		logger.Error("Scheduler crash", zap.Error(err))
+		return nil, err
+	}
+	ar.Get("/schedules", a.AdminSchedulesHandler)
+	ar.Get("/workers", a.AdminWorkersHandler)
 	// A good base middleware stack
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -176,6 +231,7 @@ func New(cfg *conf.Conf) (*Application, error) {
 					r.Group(func(r chi.Router) {
 						r.Use(authMiddleware.Middleware())
 						r.Post("/", a.PostTaskHandler)
+						r.Delete("/", a.DeleteTaskHandler)
 						r.Post("/_image", a.PostImageHandler)
 						r.Get("/", a.TaskHandler(false))
 						r.Get("/volumes/*", a.VolumesHandler(6, false))
@@ -183,10 +239,16 @@ func New(cfg *conf.Conf) (*Application, error) {
 					})
 					r.Group(func(r chi.Router) {
 						r.Use(a.RefererMiddleware)
-						r.Get("/status", badge.StatusBadge(a.storage, false)) // status of this task
-						r.Get("/badge/{badge}", a.BadgeMyTaskHandler(false))  // badge wrote by docker run
+						r.Get("/status", badge.StatusBadge(a.storage, a.Services, false)) // status of this task
+						r.Get("/badge/{badge}", a.BadgeMyTaskHandler(false))              // badge wrote by docker run
 					})
 				})
+				r.Route("/schedules", func(r chi.Router) {
+					r.Use(authMiddleware.Middleware())
+					r.Get("/", a.SchedulesHandler)
+					r.Post("/", a.PostScheduleHandler)
+					r.Delete("/{scheduleID}", a.DeleteScheduleHandler)
+				})
 				r.Route("/latest", func(r chi.Router) { // alias to latest run
 					r.Group(func(r chi.Router) {
 						r.Use(authMiddleware.Middleware())
@@ -196,7 +258,7 @@ func New(cfg *conf.Conf) (*Application, error) {
 					})
 					r.Group(func(r chi.Router) {
 						r.Use(a.RefererMiddleware)
-						r.Get("/status", badge.StatusBadge(a.storage, true))
+						r.Get("/status", badge.StatusBadge(a.storage, a.Services, true))
 						r.Get("/badge/{badge}", a.BadgeMyTaskHandler(true))
 					})
 				})
@@ -204,6 +266,35 @@ func New(cfg *conf.Conf) (*Application, error) {
 		})
 	})
 
+	if len(cfg.Workers.Tokens) > 0 {
+		r.Route("/worker", func(r chi.Router) {
+			r.Use(a.WorkerMiddleware)
+			r.Post("/register", a.PostWorkerRegisterHandler)
+			r.Post("/lease", a.PostWorkerLeaseHandler)
+			r.Post("/tasks/{taskID}/renew", a.PostWorkerRenewHandler)
+			r.Put("/tasks/{taskID}/volumes", a.PutWorkerVolumesHandler)
+			r.Put("/tasks/{taskID}/logs", a.PutWorkerLogsHandler)
+			r.Post("/tasks/{taskID}/end", a.PostWorkerEndHandler)
+		})
+	}
+
+	r.Route("/suite/{suite}/{project}/{branch}", func(r chi.Router) {
+		r.Route("/{commit}", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(authMiddleware.Middleware())
+				r.Post("/", a.PostSuiteHandler)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(a.RefererMiddleware)
+				r.Get("/status", badge.SuiteBadge(a.storage, a.suites, false))
+			})
+		})
+		r.Route("/latest", func(r chi.Router) {
+			r.Use(a.RefererMiddleware)
+			r.Get("/status", badge.SuiteBadge(a.storage, a.suites, true))
+		})
+	})
+
 	return a, nil
 }
 
@@ -224,6 +315,11 @@ func loadServices(path string) (map[string]service.Service, error) {
 		svcs[sub.Name()] = svc
 	}
 
+	err = service.ValidatePipelines(svcs)
+	if err != nil {
+		return nil, err
+	}
+
 	return svcs, nil
 }
 
@@ -240,15 +336,48 @@ func (a *Application) ListServices() []string {
 	return list
 }
 
-// Run make the app listen and serve requests
-func (a *Application) Run(listen string) error {
-	// listen for stop/restart signals and sends them to the stopper channel
-	signal.Notify(a.Stopper, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+// restoreQueue puts back in the queue the tasks found in the journal, in the same order,
+// with the same prepared environment.
+// Tasks unknown by the journal are validated again.
+// Running and interrupted tasks with a surviving container wait for it, instead of running again.
+func (a *Application) restoreQueue() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	containers, err := run.TaskContainers(ctx)
+	// non blocking error, tasks run again
+	if err != nil {
+		a.logger.Error("unable to list task containers", zap.Error(err))
+		containers = make(map[uuid.UUID]string)
+	}
 
-	// setup the router
-	a.Server = &http.Server{
-		Addr:    listen,
-		Handler: a.Router,
+	restored := make(map[uuid.UUID]bool)
+	for _, record := range a.queue.Journal.Pending() {
+		restored[record.Id] = true
+		t, err := a.storage.Get(record.Id.String())
+		// non blocking error, the task may have been pruned
+		if err != nil {
+			a.logger.Warn("journaled task not found", zap.String("task", record.Id.String()), zap.Error(err))
+			a.endJournaledTask(record.Id)
+			continue
+		}
+		if t.State != task.Ready && t.State != task.Running && t.State != task.Interrupted {
+			a.endJournaledTask(record.Id)
+			continue
+		}
+		if a.reattach(t, containers) {
+			continue
+		}
+		t.State = task.Ready
+		err = a.queue.Restore(t, record.Env)
+		if err != nil {
+			a.logger.Error("error when restoring task", zap.String("task", t.Id.String()), zap.Error(err))
+			t.State = task.Failed
+			a.endJournaledTask(record.Id)
+		}
+		err = a.storage.Upsert(t)
+		if err != nil {
+			a.logger.Error("unable to save task", zap.String("task", t.Id.String()), zap.Error(err))
+		}
 	}
 
 	// interrupted tasks becomes ready task and are added to queue
@@ -258,6 +387,12 @@ func (a *Application) Run(listen string) error {
 	}
 
 	for _, t := range tasks {
+		if restored[t.Id] {
+			continue
+		}
+		if a.reattach(t, containers) {
+			continue
+		}
 		if t.State == task.Ready || t.State == task.Interrupted {
 			t.State = task.Ready
 			parsedArgs, err := a.Services[t.Service].Validate(t.Args)
@@ -273,7 +408,7 @@ func (a *Application) Run(listen string) error {
 				continue
 			}
 
-			err = a.addTask(t, parsedArgs.Environments)
+			err = a.addTask(t, parsedArgs)
 			// non blocking error
 			if err != nil {
 				a.logger.Error("error when adding task", zap.Error(err))
@@ -281,6 +416,56 @@ func (a *Application) Run(listen string) error {
 		}
 	}
 
+	return nil
+}
+
+// reattach a running or interrupted task to its surviving container, true if it's done
+func (a *Application) reattach(t *task.Task, containers map[uuid.UUID]string) bool {
+	if t.State != task.Running && t.State != task.Interrupted {
+		return false
+	}
+	container, found := containers[t.Id]
+	if !found {
+		return false
+	}
+	err := a.queue.Reattach(t, container)
+	if err != nil {
+		a.logger.Error("error when reattaching task", zap.String("task", t.Id.String()), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// endJournaledTask removes a task from the journal
+func (a *Application) endJournaledTask(id uuid.UUID) {
+	err := a.queue.Journal.Write(queue.Record{Op: queue.OpEnd, Id: id})
+	if err != nil {
+		a.logger.Error("unable to write journal", zap.String("task", id.String()), zap.Error(err))
+	}
+}
+
+// Run make the app listen and serve requests
+func (a *Application) Run(listen string) error {
+	// listen for stop/restart signals and sends them to the stopper channel
+	signal.Notify(a.Stopper, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	// setup the router
+	a.Server = &http.Server{
+		Addr:    listen,
+		Handler: a.Router,
+	}
+
+	err := a.restoreQueue()
+	if err != nil {
+		return err
+	}
+
+	a.scheduler.Start()
+
+	var leases context.Context
+	leases, a.stopLeases = context.WithCancel(context.Background())
+	go a.queue.WatchLeases(leases)
+
 	// start and serve
 	go func() {
 		if err := a.Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -306,7 +491,7 @@ func (a *Application) AdminRun(listen string) error {
 	return nil
 }
 
-// Shutdown the server and put running tasks into interrupted state
+// Shutdown the server, wait for the running tasks, and put the ones still running into interrupted state
 func (a *Application) Shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -319,16 +504,31 @@ func (a *Application) Shutdown() error {
 		a.logger.Error("error on server shutdown", zap.Error(err))
 	}
 
+	// no more scheduled tasks
+	a.scheduler.Stop()
+	a.stopLeases()
+
+	// running tasks end with their real state, no new task starts
+	a.queue.Drain()
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), a.drainTimeout)
+	defer drainCancel()
+	if a.queue.WaitDrained(drainCtx) {
+		a.logger.Info("queue drained")
+	} else {
+		a.logger.Warn("queue drain timeout", zap.Duration("timeout", a.drainTimeout))
+	}
+
 	tasks, err := a.storage.All()
 	if err != nil {
 		return err
 	}
 
 	for _, t := range tasks {
-		// running tasks becomes interrupted tasks
+		// tasks still running becomes interrupted tasks
 		if t.State == task.Running {
 			// TODO: send a cancel request to docker ?
 			t.State = task.Interrupted
+			queue.ObserveEnd(t)
 			err := a.storage.Upsert(t)
 			// same here, non blocking error
 			if err != nil {
@@ -337,6 +537,14 @@ func (a *Application) Shutdown() error {
 		}
 	}
 
+	// tasks still running after the drain don't write their end
+	if a.queue.Journal != nil {
+		err = a.queue.Journal.Close()
+		if err != nil {
+			a.logger.Error("error when closing the queue journal", zap.Error(err))
+		}
+	}
+
 	a.logger.Info("server shutdown")
 
 	return nil
@@ -21,9 +21,12 @@ import (
 	"github.com/factorysh/microdensity/claims"
 	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/mockup"
+	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/run"
 	"github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/storage"
 	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -304,6 +307,68 @@ func TestApplicationStop(t *testing.T) {
 	assert.Equal(t, task.Interrupted, tsk.State)
 }
 
+func TestShutdownDrain(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	tests := []struct {
+		name  string
+		ends  bool
+		state task.State
+	}{
+		{name: "Drained", ends: true, state: task.Done},
+		{name: "Drain timeout", ends: false, state: task.Interrupted},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, cb, err := SpawnConfig(gitlab.URL)
+			defer cb()
+			assert.NoError(t, err)
+
+			a, err := New(cfg)
+			assert.NoError(t, err)
+			runner := &fakeRunner{release: make(chan bool)}
+			defer close(runner.release)
+			useRunner(a, cfg, runner)
+			a.Server = &http.Server{}
+			a.stopLeases = func() {}
+			a.drainTimeout = 200 * time.Millisecond
+
+			tsk := &task.Task{
+				Id:       uuid.New(),
+				Service:  "demo",
+				Project:  "group%2Fproject",
+				Branch:   "main",
+				Commit:   "8e54b1d8c5f0859370196733feeb00da022adeb5",
+				Creation: time.Now(),
+			}
+			err = a.queue.Put(tsk, map[string]string{"HELLO": "Bob"})
+			assert.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				stored, err := a.storage.Get(tsk.Id.String())
+				return err == nil && stored.State == task.Running
+			}, 5*time.Second, 10*time.Millisecond)
+
+			done := make(chan error)
+			go func() {
+				done <- a.Shutdown()
+			}()
+			if tc.ends {
+				assert.Eventually(t, func() bool {
+					return a.queue.State() == queue.Draining
+				}, 5*time.Second, 10*time.Millisecond)
+				runner.release <- true
+			}
+			assert.NoError(t, <-done)
+
+			stored, err := a.storage.Get(tsk.Id.String())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.state, stored.State)
+		})
+	}
+}
+
 func SpawnConfig(gitlabURL string) (*conf.Conf, func(), error) {
 	dataDir, err := ioutil.TempDir(os.TempDir(), "data")
 	if err != nil {
@@ -355,3 +420,52 @@ func mkRequest(key *rsa.PrivateKey) (*http.Request, error) {
 		},
 	}, nil
 }
+
+// fakeRunner runs the tasks without Docker, a run waits for its release when there is one
+type fakeRunner struct {
+	release chan bool
+	// prepareErr refuses the tasks
+	prepareErr error
+}
+
+func (f *fakeRunner) Prepare(t *task.Task, env map[string]string, options run.Options) (string, error) {
+	if f.prepareErr != nil {
+		return "", f.prepareErr
+	}
+	return "main", nil
+}
+
+func (f *fakeRunner) Check(t *task.Task, env map[string]string, options run.Options) (string, error) {
+	return f.Prepare(t, env, options)
+}
+
+func (f *fakeRunner) Attach(t *task.Task, containerID string, options run.Options) error {
+	return nil
+}
+
+func (f *fakeRunner) Run(t *task.Task) (int, error) {
+	if f.release != nil {
+		<-f.release
+	}
+	return 0, nil
+}
+
+func (f *fakeRunner) Cancel(t *task.Task) error {
+	return nil
+}
+
+func (f *fakeRunner) Forget(t *task.Task) {}
+
+func (f *fakeRunner) WriteInputs(t *task.Task, files map[string]string) error {
+	return nil
+}
+
+func (f *fakeRunner) Inputs(t *task.Task) (map[string]string, error) {
+	return nil, nil
+}
+
+// useRunner replaces the queue of the application with a queue using this runner
+func useRunner(a *Application, cfg *conf.Conf, runner queue.Runner) {
+	q := queue.NewQueue(a.storage, runner, a.Sink, a.Services, cfg)
+	a.queue = &q
+}
@@ -65,5 +65,11 @@ func AdminHomeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Version: %s", version.Version())
 	w.Write([]byte(`
 /metrics Prometheus export
+/queue Running and queued tasks
+/schedules All the schedules
+/workers Registered remote workers
+/queue/state State of the queue
+POST /queue/pause, /queue/drain, /queue/resume
+POST, DELETE /maintenance
 `))
 }
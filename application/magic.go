@@ -9,7 +9,7 @@ import (
 
 // handles Gitlab like URL Paths and translate it to a Microdensity URL
 func pathMagic(p string, baseLen int) string {
-	if !strings.HasPrefix(p, "/service/") { // early exit, magic happens only on /service/*
+	if !strings.HasPrefix(p, "/service/") && !strings.HasPrefix(p, "/suite/") { // early exit, magic happens only on /service/* and /suite/*
 		return p
 	}
 	parts := strings.Split(p, "/-/")
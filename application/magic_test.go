@@ -26,6 +26,7 @@ func TestPathMagic(t *testing.T) {
 		{name: "no magic url with project latest", path: "/service/demo/group%2Fproject/master/latest", want: "/service/demo/group%2Fproject/master/latest"},
 		{name: "magic url with project latest", path: "/service/demo/group/project/-/master/latest", want: "/service/demo/group%2Fproject/master/latest"},
 		{name: "magic url with volumes", path: "/service/demo/factory/check-my-demo/-/master/bf3dfa8fde041eda86e873f5251a6d49158ba5b3/volumes/cache/proof", want: "/service/demo/factory%2Fcheck-my-demo/master/bf3dfa8fde041eda86e873f5251a6d49158ba5b3/volumes/cache/proof"},
+		{name: "magic url with suite", path: "/suite/web/group/project/-/master/commit/status", want: "/suite/web/group%2Fproject/master/commit/status"},
 	}
 
 	for _, tc := range tests {
@@ -0,0 +1,88 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/factorysh/microdensity/queue"
+	"github.com/go-chi/render"
+	"go.uber.org/zap"
+)
+
+// AdminQueueHandler show the running and the queued tasks
+func (a *Application) AdminQueueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(a.queue.Snapshot())
+	if err != nil {
+		a.logger.Error("Json encoding error", zap.Error(err))
+	}
+}
+
+// queueControl is the state of the queue, for the admins
+type queueControl struct {
+	State       queue.State `json:"state"`
+	Maintenance bool        `json:"maintenance"`
+	Queued      int         `json:"queued"`
+}
+
+func (a *Application) renderQueueControl(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, queueControl{
+		State:       a.queue.State(),
+		Maintenance: a.queue.Maintenance(),
+		Queued:      a.queue.Len(),
+	})
+}
+
+// AdminQueueStateHandler show the state of the queue
+func (a *Application) AdminQueueStateHandler(w http.ResponseWriter, r *http.Request) {
+	a.renderQueueControl(w, r)
+}
+
+// AdminQueuePauseHandler stop starting tasks
+func (a *Application) AdminQueuePauseHandler(w http.ResponseWriter, r *http.Request) {
+	a.queue.Pause()
+	a.renderQueueControl(w, r)
+}
+
+// AdminQueueResumeHandler start tasks again
+func (a *Application) AdminQueueResumeHandler(w http.ResponseWriter, r *http.Request) {
+	a.queue.Resume()
+	a.renderQueueControl(w, r)
+}
+
+// AdminQueueDrainHandler stop starting tasks, with ?wait=true it responds when running tasks are over
+func (a *Application) AdminQueueDrainHandler(w http.ResponseWriter, r *http.Request) {
+	a.queue.Drain()
+	if r.URL.Query().Get("wait") == "true" {
+		if !a.queue.WaitDrained(r.Context()) {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}
+	a.renderQueueControl(w, r)
+}
+
+// AdminMaintenanceHandler refuse new tasks
+func (a *Application) AdminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	a.queue.SetMaintenance(true)
+	a.renderQueueControl(w, r)
+}
+
+// AdminDeleteMaintenanceHandler accept new tasks again
+func (a *Application) AdminDeleteMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	a.queue.SetMaintenance(false)
+	a.renderQueueControl(w, r)
+}
+
+// refuseInMaintenance answers 503 to new tasks during a maintenance, it returns true if the request is over
+func (a *Application) refuseInMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	if !a.queue.Maintenance() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(a.retryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	render.JSON(w, r, map[string]string{
+		"error": "maintenance, new tasks are refused",
+	})
+	return true
+}
@@ -0,0 +1,80 @@
+package application
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_claims "github.com/factorysh/microdensity/claims"
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/ratelimit"
+	_service "github.com/factorysh/microdensity/service"
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "microdensity_rate_limited_total",
+	Help: "Tasks refused by the rate limits",
+}, []string{"service", "key"})
+
+// rateLimitKeys are the buckets of the project, the user and the namespace, with the kind of each bucket
+func (a *Application) rateLimitKeys(serviceID string, svc _service.Service, claims *_claims.Claims) ([]ratelimit.Key, map[string]string) {
+	limits := a.rateLimit
+	// a service with its own limits has its own buckets
+	scope := ""
+	if svc != nil && svc.Meta().RateLimit != nil {
+		limits = limits.Override(svc.Meta().RateLimit)
+		scope = serviceID
+	}
+	keys := make([]ratelimit.Key, 0, 3)
+	kinds := make(map[string]string, 3)
+	for _, k := range []struct {
+		kind  string
+		value string
+		limit conf.RateLimit
+	}{
+		{"project", claims.ProjectPath, limits.Project},
+		{"user", claims.UserLogin, limits.User},
+		{"namespace", claims.NamespacePath, limits.Namespace},
+	} {
+		if k.value == "" {
+			continue
+		}
+		name := strings.Join([]string{scope, k.kind, k.value}, "/")
+		kinds[name] = k.kind
+		keys = append(keys, ratelimit.Key{
+			Name:  name,
+			Limit: k.limit,
+		})
+	}
+
+	return keys, kinds
+}
+
+// refuseRateLimited answers 429 when a bucket of the project, the user or the namespace is empty,
+// it returns true if the request is over
+func (a *Application) refuseRateLimited(w http.ResponseWriter, r *http.Request, serviceID string, svc _service.Service, claims *_claims.Claims) bool {
+	keys, kinds := a.rateLimitKeys(serviceID, svc, claims)
+	ok, name, retryAfter := a.limiter.Allow(time.Now(), keys...)
+	if ok {
+		return false
+	}
+	kind := kinds[name]
+	rateLimited.WithLabelValues(serviceID, kind).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	render.JSON(w, r, map[string]string{
+		"error": "too many tasks for this " + kind,
+	})
+	return true
+}
+
+// refundRateLimit gives back the token of a request which failed after refuseRateLimited
+func (a *Application) refundRateLimit(serviceID string, svc _service.Service, claims *_claims.Claims) {
+	keys, _ := a.rateLimitKeys(serviceID, svc, claims)
+	a.limiter.Refund(time.Now(), keys...)
+}
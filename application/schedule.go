@@ -0,0 +1,193 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	_claims "github.com/factorysh/microdensity/claims"
+	"github.com/factorysh/microdensity/schedule"
+	"github.com/factorysh/microdensity/task"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// schedulesDir is the schedules folder, in the data path
+const schedulesDir = "schedules"
+
+// ScheduleParam represents http parameters
+type ScheduleParam struct {
+	Cron string `json:"cron"`
+}
+
+// PostScheduleHandler create a Schedule for a branch
+func (a *Application) PostScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	project := chi.URLParam(r, "project")
+	l := a.logger.With(
+		zap.String("url", r.URL.String()),
+		zap.String("service", chi.URLParam(r, "serviceID")),
+		zap.String("project", project),
+		zap.String("branch", chi.URLParam(r, "branch")),
+	)
+
+	if !claimsAllowProject(r, project) {
+		l.Warn("Path mismatch with claims")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	serviceID := chi.URLParam(r, "serviceID")
+	if _, found := a.Services[serviceID]; !found {
+		l.Warn("Requested service not found")
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": fmt.Sprintf("unknown service %s", serviceID),
+		})
+		return
+	}
+
+	var param ScheduleParam
+	err := render.DecodeJSON(r.Body, &param)
+	if err != nil {
+		l.Warn("Body JSON decode error", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	id, err := uuid.NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	s := &schedule.Schedule{
+		Id:       id,
+		Service:  serviceID,
+		Project:  project,
+		Branch:   chi.URLParam(r, "branch"),
+		Cron:     param.Cron,
+		Creation: time.Now(),
+	}
+	err = a.scheduler.Add(s)
+	if err != nil {
+		l.Warn("Schedule error", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	l.Info("New schedule", zap.String("id", id.String()), zap.String("cron", s.Cron))
+
+	render.JSON(w, r, s)
+}
+
+// SchedulesHandler show the Schedules of a branch
+func (a *Application) SchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	service := chi.URLParam(r, "serviceID")
+	project := chi.URLParam(r, "project")
+	branch := chi.URLParam(r, "branch")
+
+	if !claimsAllowProject(r, project) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	render.JSON(w, r, a.scheduler.Filter(func(s *schedule.Schedule) bool {
+		return s.Service == service && s.Project == project && s.Branch == branch
+	}))
+}
+
+// DeleteScheduleHandler delete a Schedule of a branch
+func (a *Application) DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	project := chi.URLParam(r, "project")
+	l := a.logger.With(
+		zap.String("url", r.URL.String()),
+		zap.String("schedule", chi.URLParam(r, "scheduleID")),
+	)
+
+	if !claimsAllowProject(r, project) {
+		l.Warn("Path mismatch with claims")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "scheduleID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s, err := a.scheduler.Get(id)
+	if err != nil || s.Service != chi.URLParam(r, "serviceID") || s.Project != project || s.Branch != chi.URLParam(r, "branch") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = a.scheduler.Delete(id)
+	if err != nil {
+		l.Error("Schedule delete error", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminSchedulesHandler show all the Schedules
+func (a *Application) AdminSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(a.scheduler.All())
+	if err != nil {
+		a.logger.Error("Json encoding error", zap.Error(err))
+	}
+}
+
+// runSchedule creates a task for a schedule, with the args and the commit of the branch's latest task.
+// The commit is run again, GetByCommit returns its last run.
+func (a *Application) runSchedule(s *schedule.Schedule) (uuid.UUID, error) {
+	if a.queue.Maintenance() {
+		return uuid.Nil, errors.New("maintenance, new tasks are refused")
+	}
+	svc, found := a.Services[s.Service]
+	if !found {
+		return uuid.Nil, fmt.Errorf("unknown service %s", s.Service)
+	}
+
+	latest, err := a.storage.GetLatest(s.Service, s.Project, s.Branch)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("no task to run again for this branch: %v", err)
+	}
+
+	parsedArgs, err := svc.Validate(latest.Args)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	t := &task.Task{
+		Id:       id,
+		Service:  s.Service,
+		Project:  s.Project,
+		Branch:   s.Branch,
+		Commit:   latest.Commit,
+		Creation: time.Now(),
+		Args:     latest.Args,
+		State:    task.Ready,
+		Priority: a.priorityClass(svc, &_claims.Claims{}, parsedArgs),
+		Schedule: &s.Id,
+	}
+
+	err = a.addTask(t, parsedArgs)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,112 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/factorysh/microdensity/mockup"
+	"github.com/factorysh/microdensity/schedule"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostSchedule(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	tests := []struct {
+		name   string
+		cron   string
+		status int
+	}{
+		{name: "Hourly", cron: "0 * * * *", status: http.StatusOK},
+		{name: "Not a cron", cron: "every hour", status: http.StatusBadRequest},
+		{name: "Never fires", cron: "0 0 31 2 *", status: http.StatusBadRequest},
+	}
+
+	cli := http.Client{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := mkRequest(key)
+			assert.NoError(t, err)
+			req.Method = http.MethodPost
+			req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/schedules", srvApp.URL))
+			assert.NoError(t, err)
+			req.Body = &rc{bytes.NewBufferString(fmt.Sprintf(`{"cron": "%s"}`, tc.cron))}
+			r, err := cli.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, r.StatusCode)
+		})
+	}
+	assert.Len(t, app.scheduler.All(), 1)
+
+	// the router already refuses an unknown service, the handler doesn't trust it
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("serviceID", "wombat")
+	rctx.URLParams.Add("project", "group%2Fproject")
+	rctx.URLParams.Add("branch", "main")
+	req := httptest.NewRequest(http.MethodPost, "/service/wombat/group%2Fproject/main/schedules", bytes.NewBufferString(`{"cron": "0 * * * *"}`))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	app.PostScheduleHandler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, app.scheduler.All(), 1)
+}
+
+func TestRunSchedule(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.Workers.RemoteOnly = true
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	useRunner(app, cfg, &fakeRunner{})
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	s := &schedule.Schedule{Id: uuid.New(), Service: "demo", Project: "group%2Fproject", Branch: "main"}
+	_, err = app.runSchedule(s)
+	assert.Error(t, err, "nothing to run again")
+
+	req, err := mkRequest(key)
+	assert.NoError(t, err)
+	req.Method = http.MethodPost
+	req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/8e54b1d8c5f0859370196733feeb00da022adeb5", srvApp.URL))
+	assert.NoError(t, err)
+	req.Body = &rc{bytes.NewBufferString(`{"HELLO": "Bob"}`)}
+	r, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	id, err := app.runSchedule(s)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, app.queue.Len())
+
+	// the scheduled run is the one shown for the commit
+	tsk, err := app.storage.GetByCommit("demo", "group%2Fproject", "main", "8e54b1d8c5f0859370196733feeb00da022adeb5", false)
+	assert.NoError(t, err)
+	assert.Equal(t, id, tsk.Id)
+	assert.Equal(t, s.Id, *tsk.Schedule)
+	assert.Equal(t, "Bob", tsk.Args["HELLO"])
+}
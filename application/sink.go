@@ -82,7 +82,11 @@ func (h *HttpSink) Write(event events.Event) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 	if h.isEventSource {
-		h.w.Write([]byte("event: task\ndata: "))
+		name := "task"
+		if _, ok := event.(_event.Control); ok {
+			name = "control"
+		}
+		h.w.Write([]byte("event: " + name + "\ndata: "))
 	}
 	err := h.json.Encode(event)
 	if err != nil {
@@ -0,0 +1,161 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	_claims "github.com/factorysh/microdensity/claims"
+	"github.com/factorysh/microdensity/conf"
+	_service "github.com/factorysh/microdensity/service"
+	"github.com/factorysh/microdensity/task"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// validateSuites checks that the services of the suites exist, once by suite,
+// the tasks of a suite are found by their service
+func validateSuites(suites conf.Suites, services map[string]_service.Service) error {
+	for name, members := range suites {
+		if len(members) == 0 {
+			return fmt.Errorf("suite %s is empty", name)
+		}
+		seen := make(map[string]bool, len(members))
+		for _, member := range members {
+			if _, found := services[member.Service]; !found {
+				return fmt.Errorf("suite %s: unknown service %s", name, member.Service)
+			}
+			if seen[member.Service] {
+				return fmt.Errorf("suite %s: service %s is used twice", name, member.Service)
+			}
+			seen[member.Service] = true
+		}
+	}
+	return nil
+}
+
+// PostSuiteHandler create a Task for each service of a suite.
+// The body can override the default arguments, by service: {"service": {"arg": "value"}}
+func (a *Application) PostSuiteHandler(w http.ResponseWriter, r *http.Request) {
+	suite := chi.URLParam(r, "suite")
+	project := chi.URLParam(r, "project")
+	branch := chi.URLParam(r, "branch")
+	commit := chi.URLParam(r, "commit")
+	l := a.logger.With(
+		zap.String("suite", suite),
+		zap.String("project", project),
+	)
+
+	members, found := a.suites[suite]
+	if !found {
+		l.Warn("Requested suite not found")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if a.refuseInMaintenance(w, r) {
+		l.Info("Suite refused during maintenance")
+		return
+	}
+
+	claims, err := _claims.FromCtx(r.Context())
+	if err != nil {
+		l.Warn("Claims error", zap.Error(err))
+		panic(err)
+	}
+	if project != url.QueryEscape(claims.ProjectPath) && project != claims.ID {
+		l.Warn("Path mismatch with claims", zap.String("claims.Path", claims.ProjectPath))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var overrides map[string]map[string]interface{}
+	err = render.DecodeJSON(r.Body, &overrides)
+	if err != nil && !errors.Is(err, io.EOF) {
+		l.Warn("Body JSON decode error", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// every member is validated before the first one is queued
+	tasks := make([]*task.Task, 0, len(members))
+	arguments := make([]_service.Arguments, 0, len(members))
+	validationErrors := make(map[string]string)
+	for _, member := range members {
+		service := a.Services[member.Service]
+		args := make(map[string]interface{})
+		for k, v := range member.Args {
+			args[k] = v
+		}
+		for k, v := range overrides[member.Service] {
+			args[k] = v
+		}
+		parsedArgs, err := service.Validate(args)
+		if err != nil {
+			validationErrors[member.Service] = err.Error()
+			continue
+		}
+		id, err := uuid.NewUUID()
+		if err != nil {
+			panic(err)
+		}
+		tasks = append(tasks, &task.Task{
+			Id:       id,
+			Service:  member.Service,
+			Project:  project,
+			Branch:   branch,
+			Commit:   commit,
+			Creation: time.Now(),
+			Args:     args,
+			State:    task.Ready,
+			Priority: a.priorityClass(service, claims, parsedArgs),
+		})
+		arguments = append(arguments, parsedArgs)
+	}
+	if len(validationErrors) > 0 {
+		l.Warn("Validation error", zap.Any("errors", validationErrors))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]interface{}{
+			"errors": validationErrors,
+		})
+		return
+	}
+	// a refused request doesn't use a token
+	if a.refuseRateLimited(w, r, suite, nil, claims) {
+		l.Warn("Suite refused by the rate limits")
+		return
+	}
+
+	ids := make(map[string]string, len(tasks))
+	for i, t := range tasks {
+		err = a.addTask(t, arguments[i])
+		if err != nil {
+			l.Error("error when adding task", zap.String("task", t.Id.String()), zap.Error(err))
+			// nothing is queued, the token is given back
+			if i == 0 {
+				a.refundRateLimit(suite, nil, claims)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			render.JSON(w, r, map[string]interface{}{
+				"error": err.Error(),
+				"tasks": ids,
+			})
+			return
+		}
+		ids[t.Service] = t.Id.String()
+	}
+	l.Info("New suite", zap.Any("tasks", ids))
+
+	render.JSON(w, r, map[string]interface{}{
+		"tasks": ids,
+		"badge": strings.Join([]string{a.Domain, "suite", suite, project, branch, commit, "status"}, "/"),
+	})
+}
@@ -0,0 +1,111 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/mockup"
+	"github.com/factorysh/microdensity/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSuites(t *testing.T) {
+	demo, err := service.NewFolder("../demo/services/demo")
+	assert.NoError(t, err)
+	services := map[string]service.Service{
+		"demo": demo,
+	}
+
+	tests := []struct {
+		name   string
+		suites conf.Suites
+		valid  bool
+	}{
+		{name: "Valid", valid: true, suites: conf.Suites{"checks": {{Service: "demo"}}}},
+		{name: "Empty", valid: false, suites: conf.Suites{"checks": {}}},
+		{name: "Unknown service", valid: false, suites: conf.Suites{"checks": {{Service: "wombat"}}}},
+		{name: "Same service twice", valid: false, suites: conf.Suites{"checks": {
+			{Service: "demo", Args: map[string]interface{}{"HELLO": "Alice"}},
+			{Service: "demo", Args: map[string]interface{}{"HELLO": "Bob"}},
+		}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateSuites(tc.suites, services)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPostSuite(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.Workers.RemoteOnly = true
+	cfg.Suites = conf.Suites{
+		"checks": {{Service: "demo", Args: map[string]interface{}{"HELLO": "Bob"}}},
+	}
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	useRunner(app, cfg, &fakeRunner{})
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	tests := []struct {
+		name   string
+		suite  string
+		body   string
+		status int
+		queued int
+	}{
+		{name: "Unknown suite", suite: "wombat", status: http.StatusNotFound, queued: 0},
+		{name: "Invalid override", suite: "checks", body: `{"demo": {"HELLO": "no way!"}}`, status: http.StatusBadRequest, queued: 0},
+		{name: "Default arguments", suite: "checks", status: http.StatusOK, queued: 1},
+		{name: "Override", suite: "checks", body: `{"demo": {"HELLO": "Alice"}}`, status: http.StatusOK, queued: 2},
+	}
+
+	cli := http.Client{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := mkRequest(key)
+			assert.NoError(t, err)
+			req.Method = http.MethodPost
+			req.URL, err = url.Parse(fmt.Sprintf("%s/suite/%s/group%%2Fproject/main/8e54b1d8c5f0859370196733feeb00da022adeb5", srvApp.URL, tc.suite))
+			assert.NoError(t, err)
+			req.Body = &rc{bytes.NewBufferString(tc.body)}
+			r, err := cli.Do(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, r.StatusCode)
+			assert.Equal(t, tc.queued, app.queue.Len())
+			if r.StatusCode != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Tasks map[string]string `json:"tasks"`
+			}
+			err = json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Len(t, body.Tasks, 1)
+			stored, err := app.storage.Get(body.Tasks["demo"])
+			assert.NoError(t, err)
+			assert.Equal(t, "demo", stored.Service)
+		})
+	}
+}
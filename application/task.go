@@ -2,20 +2,21 @@ package application
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	docker "github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 	_claims "github.com/factorysh/microdensity/claims"
 	"github.com/factorysh/microdensity/html"
+	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/run"
+	_service "github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/task"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
@@ -33,6 +34,11 @@ func (a *Application) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 		zap.String("project", project),
 	)
 
+	if a.refuseInMaintenance(w, r) {
+		l.Info("Task refused during maintenance")
+		return
+	}
+
 	// get the service interface for the requested service
 	service, found := a.Services[serviceID]
 	if !found {
@@ -79,6 +85,12 @@ func (a *Application) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// a refused request doesn't use a token
+	if a.refuseRateLimited(w, r, serviceID, service, claims) {
+		l.Warn("Task refused by the rate limits")
+		return
+	}
+
 	id, err := uuid.NewUUID()
 	if err != nil {
 		panic(err)
@@ -93,11 +105,18 @@ func (a *Application) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 		Creation: time.Now(),
 		Args:     args,
 		State:    task.Ready,
+		Priority: a.priorityClass(service, claims, parsedArgs),
 	}
 
-	err = a.addTask(t, parsedArgs.Environments)
+	err = a.addTask(t, parsedArgs)
 	if err != nil {
 		l.Error("error when adding task", zap.String("task", t.Id.String()), zap.Error(err))
+		// the task is not queued, its token is given back
+		a.refundRateLimit(serviceID, service, claims)
+		w.WriteHeader(http.StatusInternalServerError)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
 		return
 	}
 
@@ -119,15 +138,36 @@ func (a *Application) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// priorityClass of a new task: the validate() choice, or the service's rules, or the server's rules
+func (a *Application) priorityClass(svc _service.Service, claims *_claims.Claims, args _service.Arguments) int {
+	if args.Priority != nil {
+		return *args.Priority
+	}
+	rules := a.priority
+	if svc.Meta().Priority != nil {
+		rules = *svc.Meta().Priority
+	}
+	return rules.Class(claims.RefProtected == "true", claims.RefType)
+}
+
 // addTask adds a task to a queue
-func (a *Application) addTask(t *task.Task, args map[string]string) error {
+func (a *Application) addTask(t *task.Task, args _service.Arguments) error {
 	err := a.storage.EnsureVolumesDir(t)
 	if err != nil {
 		return err
 	}
 
-	err = a.queue.Put(t, args)
+	volumesDir := a.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), "volumes")
+	err = run.WriteInputs(volumesDir, args.Files)
+	if err == nil {
+		err = a.queue.Put(t, args.Environments)
+	}
 	if err != nil {
+		// a task which is not queued leaves no input files
+		errRemove := os.RemoveAll(filepath.Join(volumesDir, run.InputDir))
+		if errRemove != nil {
+			a.logger.Error("Inputs remove error", zap.String("task", t.Id.String()), zap.Error(errRemove))
+		}
 		return err
 	}
 
@@ -144,6 +184,74 @@ func (a *Application) addTask(t *task.Task, args map[string]string) error {
 	return err
 }
 
+// claimsAllowProject checks the JWT claims against the project.
+// OAuth2 sessions are already checked against the project by the middleware, JWT are not.
+func claimsAllowProject(r *http.Request, project string) bool {
+	claims, err := _claims.FromCtx(r.Context())
+	if err != nil {
+		return true
+	}
+	return project == url.QueryEscape(claims.ProjectPath) || project == claims.ID
+}
+
+// DeleteTaskHandler cancel a queued or running Task
+func (a *Application) DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	project := chi.URLParam(r, "project")
+	l := a.logger.With(
+		zap.String("url", r.URL.String()),
+		zap.String("service", chi.URLParam(r, "serviceID")),
+		zap.String("project", project),
+		zap.String("branch", chi.URLParam(r, "branch")),
+		zap.String("commit", chi.URLParam(r, "commit")),
+	)
+
+	if !claimsAllowProject(r, project) {
+		l.Warn("Path mismatch with claims")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	t, err := a.storage.GetByCommit(
+		chi.URLParam(r, "serviceID"),
+		project,
+		chi.URLParam(r, "branch"),
+		chi.URLParam(r, "commit"),
+		false,
+	)
+	if err != nil {
+		l.Warn("Task get error", zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	l = l.With(zap.String("id", t.Id.String()))
+
+	err = a.queue.Cancel(t.Id)
+	if err != nil {
+		l.Warn("Task cancel error", zap.Error(err))
+		if err == queue.ErrTaskNotFound {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	l.Info("Task canceled")
+
+	render.JSON(w, r, map[string]string{
+		"id":    t.Id.String(),
+		"state": task.Canceled.String(),
+	})
+}
+
+// taskResponse is a Task, with its place in the queue while it's waiting
+type taskResponse struct {
+	*task.Task
+	Queue *queue.Item `json:"queue,omitempty"`
+}
+
 // TaskHandler show a Task
 func (a *Application) TaskHandler(latest bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -171,7 +279,13 @@ func (a *Application) TaskHandler(latest bool) http.HandlerFunc {
 			}
 			return
 		}
-		err = json.NewEncoder(w).Encode(t)
+		response := taskResponse{Task: t}
+		if t.State == task.Ready {
+			if item, found := a.queue.Waiting(t.Id); found {
+				response.Queue = &item
+			}
+		}
+		err = json.NewEncoder(w).Encode(response)
 		if err != nil {
 			l.Error("Json encoding error", zap.Error(err))
 			panic(err)
@@ -231,9 +345,9 @@ func (a *Application) TaskLogzHandler(latest bool) func(http.ResponseWriter, *ht
 			return
 		}
 
-		reader, err := t.Logs(r.Context(), false)
-		if docker.IsErrNotFound(err) {
-			l.Warn("container not found", zap.Error(err))
+		reader, err := os.Open(a.storage.GetLogsPath(t))
+		if os.IsNotExist(err) {
+			l.Warn("logs not found", zap.Error(err))
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte(http.StatusText(http.StatusNotFound)))
 			return
@@ -245,18 +359,14 @@ func (a *Application) TaskLogzHandler(latest bool) func(http.ResponseWriter, *ht
 			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
 			return
 		}
+		defer reader.Close()
 
-		// just stdout for now
-		// kudos @ndeloof, @rumpl, @glours
-		_, err = stdcopy.StdCopy(w, w, reader)
+		w.Header().Set("Content-Type", "text/plain")
+		// the logs are streamed, the status is already sent
+		err = run.ReadLogs(reader, w, w)
 		if err != nil {
-			l.Error("Task log stdcopy write error", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
+			l.Error("Task log write error", zap.Error(err))
 		}
-
-		w.Header().Set("Content-Type", "text/plain")
 	}
 
 }
@@ -287,9 +397,9 @@ func (a *Application) TaskLogsHandler(latest bool) func(http.ResponseWriter, *ht
 			return
 		}
 
-		err = a.renderLogsPageForTask(r.Context(), t, w)
-		if docker.IsErrNotFound(err) {
-			l.Warn("container not found", zap.Error(err))
+		err = a.renderLogsPageForTask(t, w)
+		if os.IsNotExist(err) {
+			l.Warn("logs not found", zap.Error(err))
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte(http.StatusText(http.StatusNotFound)))
 			return
@@ -304,15 +414,16 @@ func (a *Application) TaskLogsHandler(latest bool) func(http.ResponseWriter, *ht
 	}
 }
 
-func (a *Application) renderLogsPageForTask(ctx context.Context, t *task.Task, w http.ResponseWriter) error {
+func (a *Application) renderLogsPageForTask(t *task.Task, w http.ResponseWriter) error {
 
-	reader, err := t.Logs(ctx, false)
+	reader, err := os.Open(a.storage.GetLogsPath(t))
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
 
 	var buffer bytes.Buffer
-	_, err = stdcopy.StdCopy(&buffer, &buffer, reader)
+	err = run.ReadLogs(reader, &buffer, &buffer)
 	if err != nil {
 		return err
 	}
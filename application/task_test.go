@@ -3,16 +3,23 @@ package application
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/mockup"
+	"github.com/factorysh/microdensity/run"
 	"github.com/factorysh/microdensity/service"
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -134,3 +141,206 @@ func TestExtratPathFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteTask(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	// the queued task waits for a worker
+	cfg.Workers.RemoteOnly = true
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	useRunner(app, cfg, &fakeRunner{})
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	mkTask := func(state task.State, creation time.Time) *task.Task {
+		return &task.Task{
+			Id:       uuid.New(),
+			Service:  "demo",
+			Project:  "group%2Fproject",
+			Branch:   "main",
+			Commit:   "8e54b1d8c5f0859370196733feeb00da022adeb5",
+			Creation: creation,
+			State:    state,
+		}
+	}
+	// the same commit, run again
+	previous := mkTask(task.Done, time.Now().Add(-time.Hour))
+	err = app.storage.Upsert(previous)
+	assert.NoError(t, err)
+	queued := mkTask(task.Ready, time.Now())
+	err = app.storage.Upsert(queued)
+	assert.NoError(t, err)
+	err = app.queue.Put(queued, map[string]string{"HELLO": "Bob"})
+	assert.NoError(t, err)
+
+	cli := http.Client{}
+	del := func(commit string) *http.Response {
+		req, err := mkRequest(key)
+		assert.NoError(t, err)
+		req.Method = http.MethodDelete
+		req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/%s", srvApp.URL, commit))
+		assert.NoError(t, err)
+		r, err := cli.Do(req)
+		assert.NoError(t, err)
+		return r
+	}
+
+	r := del(queued.Commit)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	var body map[string]string
+	err = json.NewDecoder(r.Body).Decode(&body)
+	assert.NoError(t, err)
+	assert.Equal(t, queued.Id.String(), body["id"])
+	assert.Equal(t, task.Canceled, queued.State)
+	assert.Equal(t, 0, app.queue.Len())
+
+	r = del(queued.Commit)
+	assert.Equal(t, http.StatusConflict, r.StatusCode, "the task has ended")
+
+	r = del("0123456789abcdef0123456789abcdef01234567")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestCreateTaskInMaintenance(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.MaintenanceRetryAfter = 30 * time.Second
+	cfg.Workers.RemoteOnly = true
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	useRunner(app, cfg, &fakeRunner{})
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	cli := http.Client{}
+	post := func() *http.Response {
+		req, err := mkRequest(key)
+		assert.NoError(t, err)
+		req.Method = http.MethodPost
+		req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/8e54b1d8c5f0859370196733feeb00da022adeb5", srvApp.URL))
+		assert.NoError(t, err)
+		req.Body = &rc{bytes.NewBufferString(`{"HELLO": "Bob"}`)}
+		r, err := cli.Do(req)
+		assert.NoError(t, err)
+		return r
+	}
+
+	app.queue.SetMaintenance(true)
+	r := post()
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, "30", r.Header.Get("Retry-After"))
+	assert.Equal(t, 0, app.queue.Len())
+
+	app.queue.SetMaintenance(false)
+	r = post()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, 1, app.queue.Len())
+}
+
+func TestCreateTaskRateLimited(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.RateLimit.Project = conf.RateLimit{Every: time.Hour, Burst: 1}
+	cfg.Workers.RemoteOnly = true
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	runner := &fakeRunner{}
+	useRunner(app, cfg, runner)
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	cli := http.Client{}
+	post := func(body string) *http.Response {
+		req, err := mkRequest(key)
+		assert.NoError(t, err)
+		req.Method = http.MethodPost
+		req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/8e54b1d8c5f0859370196733feeb00da022adeb5", srvApp.URL))
+		assert.NoError(t, err)
+		req.Body = &rc{bytes.NewBufferString(body)}
+		r, err := cli.Do(req)
+		assert.NoError(t, err)
+		return r
+	}
+
+	// refused requests don't use the token
+	r := post(`{"HELLO": `)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	r = post(`{"nop": "Bob"}`)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	// a failed add gives its token back
+	runner.prepareErr = errors.New("no runner")
+	r = post(`{"HELLO": "Bob"}`)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode)
+	runner.prepareErr = nil
+
+	r = post(`{"HELLO": "Bob"}`)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	r = post(`{"HELLO": "Alice"}`)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+	assert.Equal(t, 1, app.queue.Len())
+}
+
+func TestCreateTaskNotQueued(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.Workers.RemoteOnly = true
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	runner := &fakeRunner{}
+	useRunner(app, cfg, runner)
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	cli := http.Client{}
+	post := func() *http.Response {
+		req, err := mkRequest(key)
+		assert.NoError(t, err)
+		req.Method = http.MethodPost
+		req.URL, err = url.Parse(fmt.Sprintf("%s/service/demo/group%%2Fproject/main/8e54b1d8c5f0859370196733feeb00da022adeb5", srvApp.URL))
+		assert.NoError(t, err)
+		req.Body = &rc{bytes.NewBufferString(`{"HELLO": "Bob"}`)}
+		r, err := cli.Do(req)
+		assert.NoError(t, err)
+		return r
+	}
+	inputs := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(cfg.DataPath, "demo", "group%2Fproject", "main", "*", "volumes", run.InputDir))
+		assert.NoError(t, err)
+		return dirs
+	}
+
+	r := post()
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Len(t, inputs(), 1)
+
+	runner.prepareErr = errors.New("no runner")
+	r = post()
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode)
+	assert.Len(t, inputs(), 1, "the refused task has no input files")
+	assert.Equal(t, 1, app.queue.Len())
+}
@@ -0,0 +1,250 @@
+package application
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/factorysh/microdensity/httpcontext"
+	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/worker"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// WorkerInfo is a registered remote worker
+type WorkerInfo struct {
+	Name       string    `json:"name"`
+	Slots      int       `json:"slots"`
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// WorkerMiddleware authenticates the remote workers with their bearer token
+func (a *Application) WorkerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		name := ""
+		for n, t := range a.workerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				name = n
+			}
+		}
+		if token == "" || name == "" {
+			a.logger.Warn("Unknown worker token", zap.String("url", r.URL.String()))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		a.workersLock.Lock()
+		if info, found := a.workers[name]; found {
+			info.LastSeen = time.Now()
+		}
+		a.workersLock.Unlock()
+
+		ctx := context.WithValue(r.Context(), httpcontext.Worker, name)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PostWorkerRegisterHandler registers a worker when it starts
+func (a *Application) PostWorkerRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	var registration worker.Registration
+	err := render.DecodeJSON(r.Body, &registration)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	a.workersLock.Lock()
+	a.workers[name] = &WorkerInfo{
+		Name:       name,
+		Slots:      registration.Slots,
+		Registered: now,
+		LastSeen:   now,
+	}
+	a.workersLock.Unlock()
+	a.logger.Info("Worker registered", zap.String("worker", name), zap.Int("slots", registration.Slots))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PostWorkerLeaseHandler leases the next task to a worker, no content if the queue is empty
+func (a *Application) PostWorkerLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	l := a.queue.Lease(name)
+	if l == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	render.JSON(w, r, l)
+}
+
+// PostWorkerRenewHandler renews the lease of a running task, a canceled task answers a conflict
+func (a *Application) PostWorkerRenewHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	expires, err := a.queue.Renew(id, name)
+	if err != nil {
+		a.leaseError(w, r, err)
+		return
+	}
+	render.JSON(w, r, map[string]time.Time{
+		"expires": expires,
+	})
+}
+
+// PutWorkerVolumesHandler extracts the volumes of a leased task, sent as a gzipped tar
+func (a *Application) PutWorkerVolumesHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t, err := a.queue.Leased(id, name)
+	if err != nil {
+		a.leaseError(w, r, err)
+		return
+	}
+
+	err = worker.Untar(r.Body, a.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), "volumes"))
+	if err != nil {
+		a.logger.Warn("Volumes upload error", zap.String("id", id.String()), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PutWorkerLogsHandler writes the logs of a leased task, sent as its JSONL logs file
+func (a *Application) PutWorkerLogsHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	t, err := a.queue.Leased(id, name)
+	if err != nil {
+		a.leaseError(w, r, err)
+		return
+	}
+
+	f, err := os.Create(a.storage.GetLogsPath(t))
+	if err != nil {
+		a.logger.Error("Logs create error", zap.String("id", id.String()), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r.Body)
+	if err != nil {
+		a.logger.Warn("Logs upload error", zap.String("id", id.String()), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PostWorkerEndHandler ends a leased task, with the result of its run
+func (a *Application) PostWorkerEndHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := a.workerName(w, r)
+	if !ok {
+		return
+	}
+	id, err := uuid.Parse(chi.URLParam(r, "taskID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var result queue.Result
+	err = render.DecodeJSON(r.Body, &result)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		render.JSON(w, r, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	err = a.queue.Complete(id, name, result)
+	if err != nil {
+		a.leaseError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// workerName is the name of the authenticated worker, an unauthorized answer is written without it
+func (a *Application) workerName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name, err := httpcontext.GetWorker(r)
+	if err != nil {
+		a.logger.Warn("Worker without name", zap.String("url", r.URL.String()), zap.Error(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	return name, true
+}
+
+// leaseError answers gone for a lost lease, conflict for a canceled task
+func (a *Application) leaseError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusGone
+	if errors.Is(err, queue.ErrLeaseCanceled) {
+		status = http.StatusConflict
+	}
+	w.WriteHeader(status)
+	render.JSON(w, r, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// AdminWorkersHandler show the registered workers
+func (a *Application) AdminWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	a.workersLock.Lock()
+	workers := make([]WorkerInfo, 0, len(a.workers))
+	for _, info := range a.workers {
+		workers = append(workers, *info)
+	}
+	a.workersLock.Unlock()
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Name < workers[j].Name
+	})
+	render.JSON(w, r, workers)
+}
@@ -0,0 +1,114 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/mockup"
+	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/task"
+	"github.com/factorysh/microdensity/worker"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerHandlers(t *testing.T) {
+	gitlab := httptest.NewServer(mockup.GitlabJWK(&key.PublicKey))
+	defer gitlab.Close()
+
+	cfg, cb, err := SpawnConfig(gitlab.URL)
+	defer cb()
+	assert.NoError(t, err)
+	cfg.Workers = conf.WorkersConf{
+		Tokens:     map[string]string{"w1": "s3cr3t", "w2": "0th3r"},
+		RemoteOnly: true,
+	}
+
+	app, err := New(cfg)
+	assert.NoError(t, err)
+	useRunner(app, cfg, &fakeRunner{})
+
+	srvApp := httptest.NewServer(app.Router)
+	defer srvApp.Close()
+
+	do := func(method, path, token string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, srvApp.URL+path, body)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return r
+	}
+
+	r := do(http.MethodPost, "/worker/lease", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+	r = do(http.MethodPost, "/worker/lease", "wrong", nil)
+	assert.Equal(t, http.StatusUnauthorized, r.StatusCode)
+
+	r = do(http.MethodPost, "/worker/register", "s3cr3t", bytes.NewBufferString(`{"slots": 2}`))
+	assert.Equal(t, http.StatusNoContent, r.StatusCode)
+	assert.Equal(t, 2, app.workers["w1"].Slots)
+
+	r = do(http.MethodPost, "/worker/lease", "s3cr3t", nil)
+	assert.Equal(t, http.StatusNoContent, r.StatusCode, "nothing to lease")
+
+	tsk := &task.Task{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "group%2Fproject",
+		Branch:   "main",
+		Commit:   "8e54b1d8c5f0859370196733feeb00da022adeb5",
+		Creation: time.Now(),
+	}
+	err = app.queue.Put(tsk, map[string]string{"HELLO": "Bob"})
+	assert.NoError(t, err)
+
+	r = do(http.MethodPost, "/worker/lease", "s3cr3t", nil)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	var l queue.Lease
+	err = json.NewDecoder(r.Body).Decode(&l)
+	assert.NoError(t, err)
+	assert.Equal(t, tsk.Id, l.Task.Id)
+	assert.Equal(t, "Bob", l.Env["HELLO"])
+
+	taskPath := fmt.Sprintf("/worker/tasks/%s", tsk.Id)
+	r = do(http.MethodPost, taskPath+"/renew", "0th3r", nil)
+	assert.Equal(t, http.StatusGone, r.StatusCode, "w2 doesn't hold the lease")
+	r = do(http.MethodPost, taskPath+"/renew", "s3cr3t", nil)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	out, err := ioutil.TempDir(os.TempDir(), "volumes-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(out)
+	err = os.WriteFile(filepath.Join(out, "result.txt"), []byte("hello"), 0644)
+	assert.NoError(t, err)
+	archive := &bytes.Buffer{}
+	err = worker.Tar(archive, out)
+	assert.NoError(t, err)
+	r = do(http.MethodPut, taskPath+"/volumes", "s3cr3t", archive)
+	assert.Equal(t, http.StatusNoContent, r.StatusCode)
+	raw, err := os.ReadFile(app.volumes.Path(tsk.Service, tsk.Project, tsk.Branch, tsk.Id.String(), "volumes", "result.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(raw))
+
+	r = do(http.MethodPost, taskPath+"/end", "s3cr3t", bytes.NewBufferString(`{"exit_code": 0}`))
+	assert.Equal(t, http.StatusNoContent, r.StatusCode)
+	stored, err := app.storage.Get(tsk.Id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, task.Done, stored.State)
+
+	r = do(http.MethodPost, taskPath+"/end", "s3cr3t", bytes.NewBufferString(`{"exit_code": 0}`))
+	assert.Equal(t, http.StatusGone, r.StatusCode, "the lease is over")
+}
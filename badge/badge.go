@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/storage"
 	"github.com/factorysh/microdensity/task"
 	"github.com/go-chi/chi/v5"
@@ -27,6 +29,10 @@ var Colors = statusToColors{
 		task.Failed: "#900603",
 		// green
 		task.Done: "#4ec820",
+		// purple - plum
+		task.TimedOut: "#8E4585",
+		// yellow - mustard
+		task.Warning: "#D4A017",
 	},
 	// blue
 	Default: "#527284",
@@ -60,8 +66,9 @@ func (b *Badge) Render(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// StatusBadge handles request to for a badge task status request
-func StatusBadge(s storage.Storage, latest bool) func(http.ResponseWriter, *http.Request) {
+// StatusBadge handles request to for a badge task status request,
+// the exit codes of the service can set the status and the color
+func StatusBadge(s storage.Storage, services map[string]service.Service, latest bool) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		service := chi.URLParam(r, "serviceID")
@@ -84,7 +91,18 @@ func StatusBadge(s storage.Storage, latest bool) func(http.ResponseWriter, *http
 			return
 		}
 
-		err = WriteBadge(fmt.Sprintf("status : %s", service), t.State.String(), Colors.Get(t.State), w)
+		status, color := t.State.String(), Colors.Get(t.State)
+		if svc, found := services[service]; found && svc != nil {
+			text, c := svc.Meta().ExitCodes.Badge(t)
+			if text != "" {
+				status = text
+			}
+			if c != "" {
+				color = badge.Color(c)
+			}
+		}
+
+		err = WriteBadge(fmt.Sprintf("status : %s", service), status, color, w)
 		if err != nil {
 			panic(err)
 		}
@@ -96,3 +114,63 @@ func WriteBadge(label string, content string, color badge.Color, w http.Response
 	w.Header().Set("content-type", "image/svg+xml")
 	return badge.Render(label, content, color, w)
 }
+
+// suiteOrder ranks the states, the first one found in a suite is its state
+var suiteOrder = []task.State{
+	task.Failed,
+	task.TimedOut,
+	task.Interrupted,
+	task.Canceled,
+	task.Running,
+	task.Ready,
+	task.Warning,
+	task.Done,
+}
+
+// SuiteState is the state of a suite, from the states of its tasks
+func SuiteState(states []task.State) task.State {
+	for _, state := range suiteOrder {
+		for _, s := range states {
+			if s == state {
+				return state
+			}
+		}
+	}
+	return task.Done
+}
+
+// SuiteBadge handles request for the aggregated status of a suite
+func SuiteBadge(s storage.Storage, suites conf.Suites, latest bool) func(http.ResponseWriter, *http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		suite := chi.URLParam(r, "suite")
+		project := chi.URLParam(r, "project")
+		branch := chi.URLParam(r, "branch")
+		commit := chi.URLParam(r, "commit")
+
+		members, found := suites[suite]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		states := make([]task.State, 0, len(members))
+		for _, member := range members {
+			t, err := s.GetByCommit(member.Service, project, branch, commit, latest)
+			if t == nil || err != nil {
+				err = WriteBadge(fmt.Sprintf("suite : %s", suite), "?!", Colors.Default, w)
+				if err != nil {
+					panic(err)
+				}
+				return
+			}
+			states = append(states, t.State)
+		}
+
+		state := SuiteState(states)
+		err := WriteBadge(fmt.Sprintf("suite : %s", suite), state.String(), Colors.Get(state), w)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
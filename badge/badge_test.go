@@ -33,7 +33,7 @@ func TestBadge(t *testing.T) {
 	r := chi.NewRouter()
 	r.Route("/s/{service:[a-z-]+}/{project}/{id}/badge", func(r chi.Router) {
 		//r.Use(_project.AssertProject)
-		r.Get("/", StatusBadge(store, false))
+		r.Get("/", StatusBadge(store, nil, false))
 	})
 
 	ts := httptest.NewServer(r)
@@ -52,3 +52,10 @@ func TestBadge(t *testing.T) {
 	// If you want to see the svg, comment the `defer os.RemoveAll(dir)`
 	fmt.Println(dir)
 }
+
+func TestSuiteState(t *testing.T) {
+	assert.Equal(t, task.Done, SuiteState([]task.State{task.Done, task.Done}))
+	assert.Equal(t, task.Running, SuiteState([]task.State{task.Done, task.Running, task.Ready}))
+	assert.Equal(t, task.Failed, SuiteState([]task.State{task.Running, task.Failed, task.TimedOut}))
+	assert.Equal(t, task.Warning, SuiteState([]task.State{task.Done, task.Warning}))
+}
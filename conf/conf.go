@@ -3,6 +3,7 @@ package conf
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,6 +17,30 @@ type Conf struct {
 	AdminListen string    `yaml:"admin_listen"`
 	DataPath    string    `yaml:"data_path"`
 	Hosts       []string  `yaml:"hosts"` // private hostnames for exposing private services, like browserless
+	// MaxConcurrentRuns is the number of tasks running at the same time, for all services
+	MaxConcurrentRuns int `yaml:"max_concurrent_runs"`
+	// RunTimeout is the default run timeout, for services without one, 0 means no timeout
+	RunTimeout time.Duration `yaml:"run_timeout"`
+	// Fairness shares the queue between projects
+	Fairness FairnessConf `yaml:"fairness"`
+	// Priority classes of the tasks, from their Gitlab ref
+	Priority PriorityConf `yaml:"priority"`
+	// RateLimit of the tasks posted
+	RateLimit RateLimitConf `yaml:"rate_limit"`
+	// Suites of services, triggered with one request
+	Suites Suites `yaml:"suites"`
+	// ShutdownTimeout is the time given to running tasks to end, when the server stops
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Metrics settings
+	Metrics MetricsConf `yaml:"metrics"`
+	// MaintenanceRetryAfter is the delay told to clients, while new tasks are refused
+	MaintenanceRetryAfter time.Duration `yaml:"maintenance_retry_after"`
+	// Limits of the task containers, services can lower the maximum
+	Limits LimitsConf `yaml:"limits"`
+	// Workers leasing tasks from this instance
+	Workers WorkersConf `yaml:"workers"`
+	// Worker settings, when this instance is a remote worker
+	Worker WorkerConf `yaml:"worker"`
 }
 
 func (c *Conf) Defaults() {
@@ -28,6 +53,30 @@ func (c *Conf) Defaults() {
 	if c.Listen == "" {
 		c.Listen = "127.0.0.1:3000"
 	}
+	if c.MaxConcurrentRuns <= 0 {
+		c.MaxConcurrentRuns = 1
+	}
+	if c.Fairness.Key == "" {
+		c.Fairness.Key = FairByProject
+	}
+	if c.Priority.Aging == 0 {
+		c.Priority.Aging = 10 * time.Minute
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 30 * time.Second
+	}
+	if c.MaintenanceRetryAfter == 0 {
+		c.MaintenanceRetryAfter = 5 * time.Minute
+	}
+	if c.Workers.Lease == 0 {
+		c.Workers.Lease = time.Minute
+	}
+	if c.Worker.Slots <= 0 {
+		c.Worker.Slots = 1
+	}
+	if c.Worker.Poll == 0 {
+		c.Worker.Poll = 5 * time.Second
+	}
 }
 
 func Open(path string) (*Conf, error) {
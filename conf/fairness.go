@@ -0,0 +1,23 @@
+package conf
+
+const (
+	// FairByProject shares the queue between projects
+	FairByProject = "project"
+	// FairByNamespace shares the queue between namespaces (Gitlab groups)
+	FairByNamespace = "namespace"
+)
+
+// FairnessConf tells how the queue is shared between its owners
+type FairnessConf struct {
+	Key     string             `yaml:"key"`     // project (default) or namespace
+	Weights map[string]float64 `yaml:"weights"` // weight by owner, like "factory/check-my-web", default is 1
+}
+
+// Weight of an owner
+func (f FairnessConf) Weight(owner string) float64 {
+	w, found := f.Weights[owner]
+	if !found || w <= 0 {
+		return 1
+	}
+	return w
+}
@@ -0,0 +1,98 @@
+package conf
+
+import (
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// Bytes is a size in bytes, written in yaml as a number or with a unit, like 512m or 2g
+type Bytes int64
+
+// UnmarshalYAML accepts a number of bytes, or a size with a unit
+func (b *Bytes) UnmarshalYAML(value *yaml.Node) error {
+	var n int64
+	if value.Decode(&n) == nil {
+		*b = Bytes(n)
+		return nil
+	}
+	n, err := units.RAMInBytes(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = Bytes(n)
+	return nil
+}
+
+// Limits of the resources of a container, 0 means no limit
+type Limits struct {
+	// CPUs is a number of CPUs, like 1.5
+	CPUs   float64 `yaml:"cpus" json:"cpus,omitempty"`
+	Memory Bytes   `yaml:"memory" json:"memory,omitempty"`
+	Pids   int64   `yaml:"pids" json:"pids,omitempty"`
+	Shm    Bytes   `yaml:"shm" json:"shm,omitempty"`
+}
+
+// LimitsConf are the limits of the containers without their own, and the maximum they can ask
+type LimitsConf struct {
+	Default Limits `yaml:"default" json:"default"`
+	Max     Limits `yaml:"max" json:"max"`
+}
+
+// Override the limits with a service's ones: its defaults replace these ones, its maximum can only be lower
+func (l LimitsConf) Override(service LimitsConf) LimitsConf {
+	if service.Default.CPUs > 0 {
+		l.Default.CPUs = service.Default.CPUs
+	}
+	if service.Default.Memory > 0 {
+		l.Default.Memory = service.Default.Memory
+	}
+	if service.Default.Pids > 0 {
+		l.Default.Pids = service.Default.Pids
+	}
+	if service.Default.Shm > 0 {
+		l.Default.Shm = service.Default.Shm
+	}
+	if service.Max.CPUs > 0 && (l.Max.CPUs == 0 || service.Max.CPUs < l.Max.CPUs) {
+		l.Max.CPUs = service.Max.CPUs
+	}
+	if service.Max.Memory > 0 && (l.Max.Memory == 0 || service.Max.Memory < l.Max.Memory) {
+		l.Max.Memory = service.Max.Memory
+	}
+	if service.Max.Pids > 0 && (l.Max.Pids == 0 || service.Max.Pids < l.Max.Pids) {
+		l.Max.Pids = service.Max.Pids
+	}
+	if service.Max.Shm > 0 && (l.Max.Shm == 0 || service.Max.Shm < l.Max.Shm) {
+		l.Max.Shm = service.Max.Shm
+	}
+	return l
+}
+
+// Apply the limits to the ones asked by a container: missing ones get the default, all are capped by the maximum
+func (l LimitsConf) Apply(asked Limits) Limits {
+	return Limits{
+		CPUs:   clampFloat(asked.CPUs, l.Default.CPUs, l.Max.CPUs),
+		Memory: Bytes(clamp(int64(asked.Memory), int64(l.Default.Memory), int64(l.Max.Memory))),
+		Pids:   clamp(asked.Pids, l.Default.Pids, l.Max.Pids),
+		Shm:    Bytes(clamp(int64(asked.Shm), int64(l.Default.Shm), int64(l.Max.Shm))),
+	}
+}
+
+func clamp(asked, def, max int64) int64 {
+	if asked <= 0 {
+		asked = def
+	}
+	if max > 0 && (asked <= 0 || asked > max) {
+		return max
+	}
+	return asked
+}
+
+func clampFloat(asked, def, max float64) float64 {
+	if asked <= 0 {
+		asked = def
+	}
+	if max > 0 && (asked <= 0 || asked > max) {
+		return max
+	}
+	return asked
+}
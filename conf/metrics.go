@@ -0,0 +1,7 @@
+package conf
+
+// MetricsConf are the Prometheus settings
+type MetricsConf struct {
+	// ProjectLabels fills the project label of the metrics, each project is a new time serie
+	ProjectLabels bool `yaml:"project_labels"`
+}
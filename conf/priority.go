@@ -0,0 +1,29 @@
+package conf
+
+import "time"
+
+// PriorityRules gives a priority class to a task, from its Gitlab ref. Higher classes run first.
+type PriorityRules struct {
+	Default   int `yaml:"default"`
+	Protected int `yaml:"protected"` // protected branches and tags
+	Tag       int `yaml:"tag"`
+}
+
+// Class of a ref, the highest matching class
+func (p PriorityRules) Class(protected bool, refType string) int {
+	class := p.Default
+	if protected && p.Protected > class {
+		class = p.Protected
+	}
+	if refType == "tag" && p.Tag > class {
+		class = p.Tag
+	}
+	return class
+}
+
+// PriorityConf are the server's priority rules
+type PriorityConf struct {
+	PriorityRules `yaml:",inline"`
+	// Aging raises a waiting task by one class for each Aging duration, 10m by default, a negative value means no aging
+	Aging time.Duration `yaml:"aging"`
+}
@@ -0,0 +1,38 @@
+package conf
+
+import "time"
+
+// RateLimit is a token bucket: one token every Every, up to Burst tokens. A zero Every means no limit.
+type RateLimit struct {
+	Every time.Duration `yaml:"every"`
+	Burst int           `yaml:"burst"`
+}
+
+// Enabled is true if the limit is set
+func (r RateLimit) Enabled() bool {
+	return r.Every > 0
+}
+
+// RateLimitConf limits the tasks posted, by project, by user, and by namespace
+type RateLimitConf struct {
+	Project   RateLimit `yaml:"project"`
+	User      RateLimit `yaml:"user"`
+	Namespace RateLimit `yaml:"namespace"`
+}
+
+// Override the limits with the enabled ones of a service
+func (r RateLimitConf) Override(service *RateLimitConf) RateLimitConf {
+	if service == nil {
+		return r
+	}
+	if service.Project.Enabled() {
+		r.Project = service.Project
+	}
+	if service.User.Enabled() {
+		r.User = service.User
+	}
+	if service.Namespace.Enabled() {
+		r.Namespace = service.Namespace
+	}
+	return r
+}
@@ -0,0 +1,10 @@
+package conf
+
+// SuiteMember is a service of a suite, with its default arguments
+type SuiteMember struct {
+	Service string                 `yaml:"service"`
+	Args    map[string]interface{} `yaml:"args"`
+}
+
+// Suites are services triggered together, by name
+type Suites map[string][]SuiteMember
@@ -0,0 +1,25 @@
+package conf
+
+import "time"
+
+// WorkersConf are the settings of the remote workers, on the main instance
+type WorkersConf struct {
+	// Tokens of the workers allowed to lease tasks, by worker name
+	Tokens map[string]string `yaml:"tokens"`
+	// Lease is the time given to a worker to renew its lease, before its task is queued again
+	Lease time.Duration `yaml:"lease"`
+	// RemoteOnly leaves all the runs to the remote workers
+	RemoteOnly bool `yaml:"remote_only"`
+}
+
+// WorkerConf are the settings of this instance, when it is a remote worker
+type WorkerConf struct {
+	// Server is the URL of the main instance
+	Server string `yaml:"server"`
+	Name   string `yaml:"name"`
+	Token  string `yaml:"token"`
+	// Slots is the number of tasks run at the same time
+	Slots int `yaml:"slots"`
+	// Poll is the delay between two lease requests, while the queue is empty
+	Poll time.Duration `yaml:"poll"`
+}
@@ -8,19 +8,33 @@ import (
 )
 
 type Event struct {
-	Id    uuid.UUID  `json:"id"`
-	State task.State `json:"state"`
-	Error error      `json:"error,omit_empty"`
+	Id           uuid.UUID  `json:"id"`
+	State        task.State `json:"state"`
+	Error        error      `json:"error,omit_empty"`
+	SupersededBy *uuid.UUID `json:"superseded_by,omitempty"`
 }
 
 func (e Event) MarshalJSON() ([]byte, error) {
+	// error interface is marshaled as an empty object, use its message
+	var msg string
+	if e.Error != nil {
+		msg = e.Error.Error()
+	}
 	return json.Marshal(struct {
-		Id    uuid.UUID `json:"id"`
-		State string    `json:"state"`
-		Error error     `json:"error"`
+		Id           uuid.UUID  `json:"id"`
+		State        string     `json:"state"`
+		Error        string     `json:"error,omitempty"`
+		SupersededBy *uuid.UUID `json:"superseded_by,omitempty"`
 	}{
-		Id:    e.Id,
-		State: e.State.String(),
-		Error: e.Error,
+		Id:           e.Id,
+		State:        e.State.String(),
+		Error:        msg,
+		SupersededBy: e.SupersededBy,
 	})
 }
+
+// Control is an event of the queue state, changed by an admin
+type Control struct {
+	Queue       string `json:"queue"`
+	Maintenance bool   `json:"maintenance"`
+}
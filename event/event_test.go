@@ -0,0 +1,32 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshal(t *testing.T) {
+	id := uuid.New()
+	raw, err := json.Marshal(Event{
+		Id:    id,
+		State: task.TimedOut,
+		Error: errors.New("run timed out"),
+	})
+	assert.NoError(t, err)
+
+	var e map[string]string
+	err = json.Unmarshal(raw, &e)
+	assert.NoError(t, err)
+	assert.Equal(t, id.String(), e["id"])
+	assert.Equal(t, "TimedOut", e["state"])
+	assert.Equal(t, "run timed out", e["error"])
+
+	raw, err = json.Marshal(Event{Id: id, State: task.Done})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "error")
+}
@@ -10,13 +10,13 @@ require (
 	github.com/docker/compose/v2 v2.2.3
 	github.com/docker/docker v20.10.12+incompatible
 	github.com/docker/go-events v0.0.0-20190806004212-e31b211e4f1c
+	github.com/docker/go-units v0.4.0
 	github.com/dop251/goja v0.0.0-20220324112439-a18ffb9c5866
 	github.com/getsentry/sentry-go v0.13.0
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/go-chi/render v1.0.1
 	github.com/google/uuid v1.3.0
 	github.com/narqo/go-badge v0.0.0-20220127184443-140af28a266e
-	github.com/oleiade/lane v1.0.1
 	github.com/prometheus/client_golang v1.12.1
 	github.com/robert-nix/ansihtml v1.0.0
 	github.com/stretchr/testify v1.7.1
@@ -52,7 +52,6 @@ require (
 	github.com/docker/go v1.5.1-1.0.20160303222718-d30aec9fd63c // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-metrics v0.0.1 // indirect
-	github.com/docker/go-units v0.4.0 // indirect
 	github.com/fvbommel/sortorder v1.0.1 // indirect
 	github.com/go-logr/logr v0.4.0 // indirect
 	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
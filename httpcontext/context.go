@@ -18,6 +18,8 @@ const (
 	// RequestedProject is the key used to check requested project from a context
 	RequestedProject Key = "RequestedProject"
 	User             Key = "User"
+	// Worker is the key used to read the name of an authenticated remote worker from a context
+	Worker Key = "Worker"
 )
 
 // GetAccessToken is used to fetch an access token from request context
@@ -79,3 +81,18 @@ func GetRequestedProject(r *http.Request) (string, error) {
 
 	return project, nil
 }
+
+// GetWorker is used to fetch the name of the remote worker from request context
+func GetWorker(r *http.Request) (string, error) {
+	rawWorker := r.Context().Value(Worker)
+	if rawWorker == nil {
+		return "", fmt.Errorf("no Worker found in httpcontext")
+	}
+
+	worker, ok := rawWorker.(string)
+	if !ok {
+		return "", fmt.Errorf("error when casting Worker value")
+	}
+
+	return worker, nil
+}
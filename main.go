@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/factorysh/microdensity/application"
 	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/version"
+	"github.com/factorysh/microdensity/worker"
 	"go.uber.org/zap"
 )
 
@@ -42,9 +46,19 @@ func main() {
 		os.Exit(1)
 	}
 	cfgPub.OAuth.AppSecret = "•••"
+	cfgPub.Worker.Token = "•••"
+	for name := range cfgPub.Workers.Tokens {
+		cfgPub.Workers.Tokens[name] = "•••"
+	}
 
 	l = l.With(zap.Any("config", cfgPub))
 
+	// `microdensity worker` runs the tasks leased from the main instance
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(cfg, l)
+		return
+	}
+
 	a, err := application.New(cfg)
 	if err != nil {
 		l.Error("Application", zap.Error(err))
@@ -75,3 +89,28 @@ func main() {
 		l.Error("error on shutdown", zap.Error(err))
 	}
 }
+
+// runWorker until a stop signal, the running tasks end first
+func runWorker(cfg *conf.Conf, l *zap.Logger) {
+	w, err := worker.New(cfg)
+	if err != nil {
+		l.Error("Worker", zap.Error(err))
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopper := make(chan os.Signal, 1)
+	signal.Notify(stopper, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stopper
+		l.Info("shutdown signal received")
+		cancel()
+	}()
+
+	l.Info("starting worker")
+	err = w.Run(ctx)
+	if err != nil {
+		l.Error("Worker run", zap.Error(err))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,26 @@
+package metrics
+
+/*
+Settings shared by the Prometheus metrics of the packages.
+*/
+
+import "sync/atomic"
+
+var projectLabels int32
+
+// SetProjectLabels fills the project label of the metrics, off by default: each project is a new time serie
+func SetProjectLabels(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&projectLabels, v)
+}
+
+// Project label value, empty when project labels are off
+func Project(project string) string {
+	if atomic.LoadInt32(&projectLabels) == 1 {
+		return project
+	}
+	return ""
+}
@@ -0,0 +1,14 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProject(t *testing.T) {
+	assert.Equal(t, "", Project("factory%2Fdemo"))
+	SetProjectLabels(true)
+	defer SetProjectLabels(false)
+	assert.Equal(t, "factory%2Fdemo", Project("factory%2Fdemo"))
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/factorysh/microdensity/event"
+	"go.uber.org/zap"
+)
+
+// State of the queue, changed by an admin
+type State string
+
+const (
+	// Active queue starts tasks
+	Active State = "active"
+	// Paused queue starts no task
+	Paused State = "paused"
+	// Draining queue starts no task, and waits for the end of the running ones
+	Draining State = "draining"
+	// Drained queue has no more running task
+	Drained State = "drained"
+)
+
+// State of the queue
+func (q *Queue) State() State {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.state
+}
+
+// Maintenance is true while new tasks are refused
+func (q *Queue) Maintenance() bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.maintenance
+}
+
+// Pause the queue, running tasks go on, queued tasks wait
+func (q *Queue) Pause() {
+	q.setControl(func() { q.state = Paused })
+}
+
+// Resume the queue, queued tasks start again
+func (q *Queue) Resume() {
+	q.setControl(func() { q.state = Active })
+	go q.DequeueWhile()
+}
+
+// Drain the queue: no new task starts, the queue is Drained when running tasks end
+func (q *Queue) Drain() {
+	q.setControl(func() {
+		if q.state == Draining || q.state == Drained {
+			return
+		}
+		q.drained = make(chan bool)
+		if len(q.running) == 0 {
+			q.state = Drained
+			close(q.drained)
+		} else {
+			q.state = Draining
+		}
+	})
+}
+
+// WaitDrained waits for the end of a drain, false if the context is done before, or if the queue is not drained
+func (q *Queue) WaitDrained(ctx context.Context) bool {
+	q.RLock()
+	state := q.state
+	drained := q.drained
+	q.RUnlock()
+
+	if state != Draining && state != Drained {
+		return false
+	}
+	select {
+	case <-drained:
+		return q.State() == Drained
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SetMaintenance mode, new tasks are refused
+func (q *Queue) SetMaintenance(maintenance bool) {
+	q.setControl(func() { q.maintenance = maintenance })
+}
+
+// setControl changes the state of the queue and broadcasts it
+func (q *Queue) setControl(change func()) {
+	q.Lock()
+	previous, drained := q.state, q.drained
+	change()
+	if previous == Draining && q.state != Draining {
+		// the drain is over, without the end of the running tasks
+		close(drained)
+	}
+	e := event.Control{
+		Queue:       string(q.state),
+		Maintenance: q.maintenance,
+	}
+	q.Unlock()
+
+	q.publishControl(e)
+}
+
+func (q *Queue) publishControl(e event.Control) {
+	q.logger.Info("Queue control", zap.String("state", e.Queue), zap.Bool("maintenance", e.Maintenance))
+	err := q.Sink.Write(e)
+	if err != nil {
+		q.logger.Error("Sink write", zap.Error(err))
+	}
+}
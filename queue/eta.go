@@ -0,0 +1,174 @@
+package queue
+
+import (
+	"sort"
+	"time"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+)
+
+// durationsKept is the number of run durations kept by service, for the estimations
+const durationsKept = 10
+
+// Item is a queued or running task, as seen by the queue
+type Item struct {
+	Id       uuid.UUID `json:"id"`
+	Service  string    `json:"service"`
+	Project  string    `json:"project"`
+	Branch   string    `json:"branch"`
+	State    string    `json:"state"`
+	Priority int       `json:"priority"`
+	Enqueued time.Time `json:"enqueued"`
+	// Started is the start of a running task
+	Started *time.Time `json:"started,omitempty"`
+	// Position of a queued task, 1 is the next one to run
+	Position int `json:"position,omitempty"`
+	// ETA is the estimated start of a queued task, from the previous run durations
+	ETA *time.Time `json:"eta,omitempty"`
+}
+
+// recordDuration of a run
+func (q *Queue) recordDuration(service string, d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	durations := append(q.durations[service], d)
+	if len(durations) > durationsKept {
+		durations = durations[len(durations)-durationsKept:]
+	}
+	q.durations[service] = durations
+}
+
+// duration of a service's run, the mean of the previous ones, false without history.
+// The queue must be locked.
+func (q *Queue) duration(service string) (time.Duration, bool) {
+	durations := q.durations[service]
+	if len(durations) == 0 {
+		return 0, false
+	}
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	return total / time.Duration(len(durations)), true
+}
+
+// order of the queued items, predicted with the dequeue rules.
+// Per service limits are ignored, they depend on the end of the runs.
+// The queue must be locked.
+func (q *Queue) order(now time.Time) []*task.Task {
+	passes := make(map[string]float64, len(q.passes))
+	for o, p := range q.passes {
+		passes[o] = p
+	}
+	virtual := q.virtual
+	pass := func(owner string) float64 {
+		p, found := passes[owner]
+		if !found || p < virtual {
+			return virtual
+		}
+		return p
+	}
+
+	remaining := make([]*task.Task, len(q.items))
+	copy(remaining, q.items)
+	ordered := make([]*task.Task, 0, len(remaining))
+	for len(remaining) > 0 {
+		classes := make(map[int]int, len(remaining))
+		for i, t := range remaining {
+			classes[i] = q.class(t, now)
+		}
+		chosen, chosenPass := q.choose(remaining, classes, pass)
+		t := remaining[chosen]
+		owner := q.owner(t)
+		virtual = chosenPass
+		passes[owner] = chosenPass + 1/q.fairness.Weight(owner)
+		ordered = append(ordered, t)
+		remaining = append(remaining[:chosen], remaining[chosen+1:]...)
+	}
+	return ordered
+}
+
+// Snapshot of the queue: running tasks, oldest first, then queued tasks, in the predicted order
+func (q *Queue) Snapshot() []Item {
+	q.RLock()
+	defer q.RUnlock()
+
+	now := time.Now()
+	items := make([]Item, 0, len(q.running)+len(q.items))
+
+	// the run slots, free at this time
+	slots := make([]time.Time, 0, q.maxRuns)
+	known := true
+	for _, t := range q.running {
+		started := q.started[t.Id]
+		items = append(items, Item{
+			Id:       t.Id,
+			Service:  t.Service,
+			Project:  t.Project,
+			Branch:   t.Branch,
+			State:    task.Running.String(),
+			Priority: t.Priority,
+			Enqueued: q.enqueued[t.Id],
+			Started:  &started,
+		})
+		d, found := q.duration(t.Service)
+		if !found {
+			known = false
+		}
+		end := started.Add(d)
+		if end.Before(now) {
+			end = now
+		}
+		slots = append(slots, end)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Started.Before(*items[j].Started)
+	})
+	for len(slots) < q.maxRuns {
+		slots = append(slots, now)
+	}
+
+	for i, t := range q.order(now) {
+		item := Item{
+			Id:       t.Id,
+			Service:  t.Service,
+			Project:  t.Project,
+			Branch:   t.Branch,
+			State:    task.Ready.String(),
+			Priority: t.Priority,
+			Enqueued: q.enqueued[t.Id],
+			Position: i + 1,
+		}
+		// the task starts when the first slot is free
+		first := 0
+		for s := range slots {
+			if slots[s].Before(slots[first]) {
+				first = s
+			}
+		}
+		if known {
+			eta := slots[first]
+			item.ETA = &eta
+		}
+		d, found := q.duration(t.Service)
+		if !found {
+			known = false
+		}
+		slots[first] = slots[first].Add(d)
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// Waiting returns a queued task, with its position and its estimated start
+func (q *Queue) Waiting(id uuid.UUID) (Item, bool) {
+	for _, item := range q.Snapshot() {
+		if item.Id == id && item.Position > 0 {
+			return item, true
+		}
+	}
+	return Item{}, false
+}
@@ -0,0 +1,224 @@
+package queue
+
+/*
+The journal keeps the queue on the disk, it survives crashes.
+Each line is a JSON record: a task is enqueued, dequeued, or ended.
+Records only hold ids and environments, the tasks are in the storage.
+A crash truncates the last line, not the whole journal.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Op is the kind of a journal record
+type Op string
+
+const (
+	// OpEnqueue a task, with its prepared environment
+	OpEnqueue Op = "enqueue"
+	// OpDequeue a task, it starts running
+	OpDequeue Op = "dequeue"
+	// OpEnd a task, it will never run again
+	OpEnd Op = "end"
+)
+
+// Record is a line of the journal
+type Record struct {
+	Op  Op                `json:"op"`
+	Id  uuid.UUID         `json:"id"`
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// compactEvery is the number of ended tasks between two compactions of the journal
+const compactEvery = 1000
+
+// ErrJournalClosed is returned by a write after the close of the journal
+var ErrJournalClosed = errors.New("journal is closed")
+
+// Journal is an append only file of Record
+type Journal struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	pending []Record
+	// ends are the ended tasks since the last compaction
+	ends         int
+	compactEvery int
+}
+
+// OpenJournal replays a journal, compacts it, and opens it for appending
+func OpenJournal(path string) (*Journal, error) {
+	path = filepath.Clean(path)
+	pending, err := compact(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		path:         path,
+		file:         f,
+		pending:      pending,
+		compactEvery: compactEvery,
+	}, nil
+}
+
+// compact a journal file: only pending tasks are written back, it returns them
+func compact(path string) ([]Record, error) {
+	pending, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(f)
+	for _, record := range pending {
+		err = encoder.Encode(record)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	err = f.Sync()
+	err2 := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err2 != nil {
+		return nil, err2
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// replay a journal file, returns enqueued tasks not yet ended, in the queue order
+func replay(path string) ([]Record, error) {
+	f, err := os.Open(path) //#nosec
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Record{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	order := make([]uuid.UUID, 0)
+	position := make(map[uuid.UUID]int)
+	records := make(map[uuid.UUID]Record)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// a crash can leave a truncated last line
+			continue
+		}
+		switch record.Op {
+		case OpEnqueue:
+			// an enqueued again task goes to the end of the queue
+			position[record.Id] = len(order)
+			order = append(order, record.Id)
+			records[record.Id] = record
+		case OpEnd:
+			delete(records, record.Id)
+		}
+		// a dequeued task without end was running during the crash, it stays pending
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	pending := make([]Record, 0, len(records))
+	for i, id := range order {
+		if record, found := records[id]; found && position[id] == i {
+			pending = append(pending, record)
+		}
+	}
+	return pending, nil
+}
+
+// Pending are the tasks found in the journal when it was opened
+func (j *Journal) Pending() []Record {
+	return j.pending
+}
+
+// Write a record and flush it to the disk, the journal is compacted after many ended tasks
+func (j *Journal) Write(record Record) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(raw, '\n'))
+	if err != nil {
+		return err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	if record.Op != OpEnd {
+		return nil
+	}
+	j.ends++
+	if j.ends < j.compactEvery {
+		return nil
+	}
+	return j.compact()
+}
+
+// compact the journal file and open it again. The journal must be locked.
+func (j *Journal) compact() error {
+	err := j.file.Close()
+	if err != nil {
+		return err
+	}
+	j.file = nil
+	// a failed compaction leaves the journal as it was, it's still appended
+	_, errCompact := compact(j.path)
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.ends = 0
+	return errCompact
+}
+
+// Close the journal file, the next writes are refused
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
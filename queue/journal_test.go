@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "journal-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "queue.journal")
+
+	j, err := OpenJournal(pth)
+	assert.NoError(t, err)
+	assert.Len(t, j.Pending(), 0)
+
+	alice, bob, carol, dave := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	for _, r := range []Record{
+		{Op: OpEnqueue, Id: alice, Env: map[string]string{"HELLO": "Alice"}},
+		{Op: OpEnqueue, Id: bob, Env: map[string]string{"HELLO": "Bob"}},
+		{Op: OpEnqueue, Id: carol},
+		{Op: OpDequeue, Id: alice},
+		{Op: OpDequeue, Id: bob},
+		{Op: OpEnd, Id: bob},
+		{Op: OpEnqueue, Id: dave},
+	} {
+		err = j.Write(r)
+		assert.NoError(t, err)
+	}
+	err = j.Close()
+	assert.NoError(t, err)
+
+	// a crash during a write
+	f, err := os.OpenFile(pth, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(`{"op":"end","id":"`))
+	assert.NoError(t, err)
+	f.Close()
+
+	j, err = OpenJournal(pth)
+	assert.NoError(t, err)
+	pending := j.Pending()
+	assert.Len(t, pending, 3)
+	assert.Equal(t, alice, pending[0].Id, "alice was running")
+	assert.Equal(t, "Alice", pending[0].Env["HELLO"])
+	assert.Equal(t, carol, pending[1].Id)
+	assert.Equal(t, dave, pending[2].Id)
+
+	// carol is enqueued again, after dave
+	err = j.Write(Record{Op: OpEnqueue, Id: carol})
+	assert.NoError(t, err)
+	err = j.Close()
+	assert.NoError(t, err)
+
+	j, err = OpenJournal(pth)
+	assert.NoError(t, err)
+	pending = j.Pending()
+	assert.Len(t, pending, 3)
+	assert.Equal(t, []uuid.UUID{alice, dave, carol}, []uuid.UUID{pending[0].Id, pending[1].Id, pending[2].Id})
+	assert.NoError(t, j.Close())
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "journal-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "queue.journal")
+
+	j, err := OpenJournal(pth)
+	assert.NoError(t, err)
+	j.compactEvery = 2
+
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	for _, r := range []Record{
+		{Op: OpEnqueue, Id: alice},
+		{Op: OpEnqueue, Id: bob},
+		{Op: OpEnqueue, Id: carol, Env: map[string]string{"HELLO": "Carol"}},
+		{Op: OpDequeue, Id: alice},
+		{Op: OpEnd, Id: alice},
+		{Op: OpDequeue, Id: bob},
+		{Op: OpEnd, Id: bob},
+	} {
+		err = j.Write(r)
+		assert.NoError(t, err)
+	}
+	// the second end compacts the journal
+	raw, err := ioutil.ReadFile(pth)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(raw, []byte("\n")), "only carol is left")
+
+	err = j.Write(Record{Op: OpDequeue, Id: carol})
+	assert.NoError(t, err)
+	assert.NoError(t, j.Close())
+	assert.Equal(t, ErrJournalClosed, j.Write(Record{Op: OpEnd, Id: carol}))
+	assert.NoError(t, j.Close(), "closing twice is harmless")
+
+	j, err = OpenJournal(pth)
+	assert.NoError(t, err)
+	pending := j.Pending()
+	assert.Len(t, pending, 1)
+	assert.Equal(t, carol, pending[0].Id)
+	assert.Equal(t, "Carol", pending[0].Env["HELLO"])
+	assert.NoError(t, j.Close())
+}
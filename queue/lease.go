@@ -0,0 +1,210 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/run"
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrLeaseNotFound is returned when a worker uses a lease it doesn't hold, or an expired one
+	ErrLeaseNotFound = errors.New("lease not found")
+	// ErrLeaseCanceled is returned when a leased task is canceled, the worker must stop its run
+	ErrLeaseCanceled = errors.New("leased task is canceled")
+	// ErrLeaseExpired is the error of a run lost with its worker
+	ErrLeaseExpired = errors.New("lease expired")
+)
+
+// lease of a running task, by a remote worker
+type lease struct {
+	worker  string
+	expires time.Time
+}
+
+// Lease of a task, sent to the remote worker which runs it
+type Lease struct {
+	Task *task.Task        `json:"task"`
+	Env  map[string]string `json:"env"`
+	// Files are the input files of the task
+	Files   map[string]string `json:"files,omitempty"`
+	Expires time.Time         `json:"expires"`
+	// Timeout of the run, 0 means no timeout
+	Timeout time.Duration `json:"timeout"`
+	// Limits of the containers
+	Limits conf.LimitsConf `json:"limits"`
+	// Network policy of the task's network
+	Network run.NetworkPolicy `json:"network"`
+	// KeepOnFailure leaves the containers of a failed run
+	KeepOnFailure bool `json:"keep_on_failure"`
+	// Container of a single container service
+	Container *run.Container `json:"container,omitempty"`
+}
+
+// Result of a run, sent back by a remote worker
+type Result struct {
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+}
+
+// Lease the next task to a remote worker, nil if no task can run.
+// The task uses a run slot until the worker completes it, or stops renewing its lease.
+func (q *Queue) Lease(worker string) *Lease {
+	t := q.dequeue()
+	if t == nil {
+		return nil
+	}
+	q.dequeued(t)
+	// the worker prepares it again, on its side, nothing is prepared here in remote only mode
+	q.runner.Forget(t)
+
+	expires := time.Now().Add(q.leaseTime)
+	q.Lock()
+	q.leases[t.Id] = &lease{
+		worker:  worker,
+		expires: expires,
+	}
+	env := q.envs[t.Id]
+	t.State = task.Running
+	if t.Attempt == 0 {
+		t.Attempt = 1
+	}
+	t.ExitCode = nil
+	q.Unlock()
+
+	err := q.storage.Upsert(t)
+	if err != nil {
+		q.logger.Error("Storage upsert", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+
+	files, err := q.runner.Inputs(t)
+	if err != nil {
+		q.logger.Error("Read inputs", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+
+	q.logger.Info("Queue lease", zap.String("id", t.Id.String()), zap.String("worker", worker))
+	options := q.runOptions(t.Service)
+	return &Lease{
+		Task:          t,
+		Env:           env,
+		Files:         files,
+		Expires:       expires,
+		Timeout:       options.Timeout,
+		Limits:        options.Limits,
+		Network:       options.Network,
+		KeepOnFailure: options.KeepOnFailure,
+		Container:     options.Container,
+	}
+}
+
+// Leased returns the task leased by a worker
+func (q *Queue) Leased(id uuid.UUID, worker string) (*task.Task, error) {
+	q.RLock()
+	defer q.RUnlock()
+
+	l, found := q.leases[id]
+	if !found || l.worker != worker {
+		return nil, ErrLeaseNotFound
+	}
+	return q.running[id], nil
+}
+
+// Renew the lease of a worker, it returns ErrLeaseCanceled when the worker must stop the run
+func (q *Queue) Renew(id uuid.UUID, worker string) (time.Time, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	l, found := q.leases[id]
+	if !found || l.worker != worker {
+		return time.Time{}, ErrLeaseNotFound
+	}
+	if _, canceled := q.canceled[id]; canceled {
+		return l.expires, ErrLeaseCanceled
+	}
+	l.expires = time.Now().Add(q.leaseTime)
+	return l.expires, nil
+}
+
+// Complete a leased task with the result of its run, like a local run
+func (q *Queue) Complete(id uuid.UUID, worker string, result Result) error {
+	q.Lock()
+	l, found := q.leases[id]
+	if !found || l.worker != worker {
+		q.Unlock()
+		return ErrLeaseNotFound
+	}
+	delete(q.leases, id)
+	t := q.running[id]
+	q.Unlock()
+
+	var err error
+	if result.TimedOut {
+		err = run.ErrTimeout
+	} else if result.Error != "" {
+		err = errors.New(result.Error)
+	}
+	q.logger.Info("Queue complete", zap.String("id", id.String()), zap.String("worker", worker))
+	delay, retry := q.conclude(t, result.ExitCode, err)
+	q.end(t, delay, retry)
+	return nil
+}
+
+// expireLeases puts back in the queue the tasks of the workers which stopped renewing their lease
+func (q *Queue) expireLeases(now time.Time) {
+	q.Lock()
+	expired := make([]*task.Task, 0)
+	for id, l := range q.leases {
+		if !now.After(l.expires) {
+			continue
+		}
+		delete(q.leases, id)
+		if t, found := q.running[id]; found {
+			expired = append(expired, t)
+		}
+	}
+	q.Unlock()
+
+	for _, t := range expired {
+		q.RLock()
+		_, canceled := q.canceled[t.Id]
+		started := q.started[t.Id]
+		env := q.envs[t.Id]
+		q.RUnlock()
+		q.logger.Warn("Lease expired", zap.String("id", t.Id.String()))
+		if canceled {
+			delay, retry := q.conclude(t, 0, nil)
+			q.end(t, delay, retry)
+			continue
+		}
+
+		addAttempt(t, started, task.Interrupted, 0, ErrLeaseExpired)
+		q.release(t)
+		q.ready(t)
+		if q.enqueueAgain(t, env) {
+			q.logger.Info("queue again", zap.String("id", t.Id.String()))
+		}
+	}
+	if len(expired) > 0 {
+		q.DequeueWhile()
+	}
+}
+
+// WatchLeases expires the leases of the lost workers, until the context is done
+func (q *Queue) WatchLeases(ctx context.Context) {
+	ticker := time.NewTicker(q.leaseTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			q.expireLeases(now)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// chain puts the downstream tasks of a Done task into the queue
+func (q *Queue) chain(parent *task.Task) {
+	for _, d := range q.meta(parent.Service).Then {
+		l := q.logger.With(
+			zap.String("parent", parent.Id.String()),
+			zap.String("service", d.Service),
+		)
+		svc, found := q.services[d.Service]
+		if !found {
+			l.Error("Unknown downstream service")
+			continue
+		}
+		args := d.Arguments(parent.Args)
+		parsedArgs, err := svc.Validate(args)
+		if err != nil {
+			l.Error("Downstream validation error", zap.Error(err))
+			continue
+		}
+
+		id, err := uuid.NewUUID()
+		if err != nil {
+			l.Error("UUID error", zap.Error(err))
+			continue
+		}
+		child := &task.Task{
+			Id:       id,
+			Service:  d.Service,
+			Project:  parent.Project,
+			Branch:   parent.Branch,
+			Commit:   parent.Commit,
+			Creation: time.Now(),
+			Args:     args,
+			State:    task.Ready,
+			Priority: parent.Priority,
+			Parent:   &parent.Id,
+		}
+		if parsedArgs.Priority != nil {
+			child.Priority = *parsedArgs.Priority
+		}
+
+		err = q.storage.EnsureVolumesDir(child)
+		if err != nil {
+			l.Error("Downstream volumes error", zap.Error(err))
+			continue
+		}
+		err = q.runner.WriteInputs(child, parsedArgs.Files)
+		if err != nil {
+			l.Error("Downstream inputs error", zap.Error(err))
+			continue
+		}
+		err = q.Put(child, parsedArgs.Environments)
+		if err != nil {
+			l.Error("Downstream queue error", zap.Error(err))
+			continue
+		}
+		err = q.storage.Upsert(child)
+		if err != nil {
+			l.Error("Storage upsert", zap.Error(err))
+		}
+		err = q.storage.SetLatest(child)
+		if err != nil {
+			l.Error("Storage set latest", zap.Error(err))
+		}
+
+		parent.Children = append(parent.Children, id)
+		l.Info("Downstream task", zap.String("id", id.String()))
+	}
+}
@@ -1,15 +1,21 @@
 package queue
 
 import (
-	"fmt"
+	"errors"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/go-events"
+	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/event"
+	"github.com/factorysh/microdensity/metrics"
 	"github.com/factorysh/microdensity/run"
+	"github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/storage"
 	"github.com/factorysh/microdensity/task"
-	"github.com/oleiade/lane"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
@@ -25,34 +31,117 @@ var (
 		Name: "microdensity_queue_size",
 		Help: "Queue size",
 	})
+
+	queueRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "microdensity_queue_running",
+		Help: "Number of tasks currently running",
+	})
+
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "microdensity_queue_wait_seconds",
+		Help:    "Time spent in the queue, by service",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"service", "project"})
+
+	taskEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "microdensity_task_ended_total",
+		Help: "Tasks ended, by service and final state",
+	}, []string{"service", "project", "state"})
 )
 
+// ErrTaskNotFound is returned when a task is neither queued nor running
+var ErrTaskNotFound = errors.New("task not found in queue")
+
 // Queue struct use to put and get job items
 type Queue struct {
 	sync.RWMutex
-	items      *lane.Queue
-	runner     *run.Runner
-	storage    storage.Storage
-	BatchEnded chan bool
-	logger     *zap.Logger
-	working    bool
-	Sink       events.Sink
+	items       []*task.Task
+	running     map[uuid.UUID]*task.Task
+	canceled    map[uuid.UUID]uuid.UUID
+	perService  map[string]int
+	enqueued    map[uuid.UUID]time.Time
+	started     map[uuid.UUID]time.Time
+	durations   map[string][]time.Duration
+	envs        map[uuid.UUID]map[string]string
+	retrying    map[uuid.UUID]*task.Task
+	leases      map[uuid.UUID]*lease
+	leaseTime   time.Duration
+	limits      conf.LimitsConf
+	remoteOnly  bool
+	fairness    conf.FairnessConf
+	passes      map[string]float64
+	virtual     float64
+	aging       time.Duration
+	maxRuns     int
+	timeout     time.Duration
+	services    map[string]service.Service
+	runner      Runner
+	storage     storage.Storage
+	BatchEnded  chan bool
+	logger      *zap.Logger
+	working     bool
+	state       State
+	drained     chan bool
+	maintenance bool
+	Sink        events.Sink
+	Journal     *Journal
+}
+
+// Runner prepares and runs the tasks of the queue, a run.Runner
+type Runner interface {
+	Prepare(t *task.Task, env map[string]string, options run.Options) (string, error)
+	Check(t *task.Task, env map[string]string, options run.Options) (string, error)
+	Attach(t *task.Task, containerID string, options run.Options) error
+	Run(t *task.Task) (int, error)
+	Cancel(t *task.Task) error
+	Forget(t *task.Task)
+	WriteInputs(t *task.Task, files map[string]string) error
+	Inputs(t *task.Task) (map[string]string, error)
 }
 
 // NewQueue inits a new queue struct
-func NewQueue(sto storage.Storage, runner *run.Runner, sink events.Sink) Queue {
+func NewQueue(sto storage.Storage, runner Runner, sink events.Sink, services map[string]service.Service, cfg *conf.Conf) Queue {
 	logger, err := zap.NewProduction()
 	if err != nil {
 		panic(err)
 	}
+	maxRuns := cfg.MaxConcurrentRuns
+	if maxRuns < 1 {
+		maxRuns = 1
+	}
+	leaseTime := cfg.Workers.Lease
+	if leaseTime <= 0 {
+		leaseTime = time.Minute
+	}
 	queueSize.Set(0)
-	logger.Info("New queue")
+	queueRunning.Set(0)
+	logger.Info("New queue", zap.Int("max concurrent runs", maxRuns))
 	return Queue{
-		items:      lane.NewQueue(),
+		items:      make([]*task.Task, 0),
+		running:    make(map[uuid.UUID]*task.Task),
+		canceled:   make(map[uuid.UUID]uuid.UUID),
+		perService: make(map[string]int),
+		enqueued:   make(map[uuid.UUID]time.Time),
+		started:    make(map[uuid.UUID]time.Time),
+		durations:  make(map[string][]time.Duration),
+		envs:       make(map[uuid.UUID]map[string]string),
+		retrying:   make(map[uuid.UUID]*task.Task),
+		leases:     make(map[uuid.UUID]*lease),
+		leaseTime:  leaseTime,
+		limits:     cfg.Limits,
+		remoteOnly: cfg.Workers.RemoteOnly,
+		fairness:   cfg.Fairness,
+		passes:     make(map[string]float64),
+		aging:      cfg.Priority.Aging,
+		maxRuns:    maxRuns,
+		timeout:    cfg.RunTimeout,
+		services:   services,
 		BatchEnded: make(chan bool, 1),
 		runner:     runner,
 		storage:    sto,
 		logger:     logger,
+		state:      Active,
+		drained:    make(chan bool),
 		Sink:       sink,
 	}
 }
@@ -62,103 +151,628 @@ func (q *Queue) Len() int {
 	q.RLock()
 	defer q.RUnlock()
 
-	return q.items.Size()
+	return len(q.items)
+}
+
+// Working is true while at least one task is running
+func (q *Queue) Working() bool {
+	q.RLock()
+	defer q.RUnlock()
+
+	return q.working
 }
 
 // Put a new item into the queue and the storage
 func (q *Queue) Put(item *task.Task, env map[string]string) error {
-	q.Lock()
-	defer q.Unlock()
+	return q.put(item, env, true)
+}
 
-	runnable, err := q.runner.Prepare(item, env)
+// Restore an item found in the journal, without writing it again
+func (q *Queue) Restore(item *task.Task, env map[string]string) error {
+	return q.put(item, env, false)
+}
+
+func (q *Queue) put(item *task.Task, env map[string]string, journaled bool) error {
+	prepare := q.runner.Prepare
+	if q.remoteOnly {
+		// the worker prepares the run, the main instance doesn't need Docker
+		prepare = q.runner.Check
+	}
+	runnable, err := prepare(item, env, q.runOptions(item.Service))
 	if err != nil {
 		return err
 	}
 
 	item.Run = runnable
 
-	q.items.Enqueue(item)
+	if journaled {
+		err = q.journal(Record{
+			Op:  OpEnqueue,
+			Id:  item.Id,
+			Env: env,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	queueAdded.Inc()
-	queueSize.Inc()
-	q.logger.Info("queue add", zap.Any("task", item))
-	err = q.Sink.Write(event.Event{
+	q.Lock()
+	superseded := q.supersede(item)
+	// a worker can start the item as soon as it's in the queue
+	added := event.Event{
 		Id:    item.Id,
 		State: item.State,
-	})
+	}
+	l := q.logger.With(
+		zap.String("id", item.Id.String()),
+		zap.String("service", item.Service),
+		zap.String("project", item.Project),
+		zap.String("branch", item.Branch),
+	)
+	q.items = append(q.items, item)
+	q.enqueued[item.Id] = time.Now()
+	q.envs[item.Id] = env
+	q.Unlock()
+
+	for _, t := range superseded {
+		q.logger.Info("Superseded task",
+			zap.String("id", t.Id.String()),
+			zap.String("by", added.Id.String()))
+		q.cancelQueued(t)
+	}
+
+	queueAdded.Inc()
+	queueSize.Inc()
+	l.Info("queue add")
+	err = q.Sink.Write(added)
 	if err != nil {
 		return err
 	}
 
-	if !q.working {
-		q.logger.Info("Start queue")
-		go q.DequeueWhile()
+	go q.DequeueWhile()
+
+	return nil
+}
+
+// Reattach a task to its container, started before a restart, it waits for its end as a running task
+func (q *Queue) Reattach(t *task.Task, containerID string) error {
+	err := q.runner.Attach(t, containerID, q.runOptions(t.Service))
+	if err != nil {
+		return err
 	}
 
+	q.Lock()
+	q.running[t.Id] = t
+	q.started[t.Id] = time.Now()
+	q.perService[t.Service]++
+	q.working = true
+	q.Unlock()
+	queueRunning.Inc()
+
+	q.logger.Info("Queue reattach", zap.String("id", t.Id.String()), zap.String("container", containerID))
+	go q.work(t)
 	return nil
 }
 
-// dequeue one item
-func (q *Queue) dequeue() interface{} {
+// journal a record, if the queue has a journal
+func (q *Queue) journal(record Record) error {
+	if q.Journal == nil {
+		return nil
+	}
+	return q.Journal.Write(record)
+}
+
+// meta of a service, empty if the service is unknown
+func (q *Queue) meta(name string) service.Meta {
+	svc, found := q.services[name]
+	if !found || svc == nil {
+		return service.Meta{}
+	}
+	return svc.Meta()
+}
+
+// runOptions of a service, with the server's defaults
+func (q *Queue) runOptions(name string) run.Options {
+	options := q.meta(name).RunOptions()
+	if options.Timeout == 0 {
+		options.Timeout = q.timeout
+	}
+	options.Limits = q.limits.Override(options.Limits)
+	return options
+}
+
+// owner of a task, used to share the queue
+func (q *Queue) owner(t *task.Task) string {
+	project, err := url.PathUnescape(t.Project)
+	if err != nil {
+		project = t.Project
+	}
+	if q.fairness.Key == conf.FairByNamespace {
+		if i := strings.LastIndex(project, "/"); i > 0 {
+			return project[:i]
+		}
+	}
+	return project
+}
+
+// pass of an owner, an idle owner doesn't save up its turns
+func (q *Queue) pass(owner string) float64 {
+	p, found := q.passes[owner]
+	if !found || p < q.virtual {
+		return q.virtual
+	}
+	return p
+}
+
+// class of a task, its priority raised by the time spent in the queue
+func (q *Queue) class(t *task.Task, now time.Time) int {
+	class := t.Priority
+	enqueued, found := q.enqueued[t.Id]
+	if q.aging > 0 && found {
+		class += int(now.Sub(enqueued) / q.aging)
+	}
+	return class
+}
+
+// dequeue an item allowed to run, nil if the queue is empty or every run slot is used.
+// The highest class goes first, then owners take turns, weighted by the fairness settings,
+// each owner's items are FIFO.
+func (q *Queue) dequeue() *task.Task {
 	q.Lock()
 	defer q.Unlock()
 
+	if q.state != Active || len(q.running) >= q.maxRuns {
+		return nil
+	}
+
+	now := time.Now()
+	classes := make(map[int]int)
+	for i, t := range q.items {
+		limit := q.meta(t.Service).MaxConcurrentRuns
+		if limit > 0 && q.perService[t.Service] >= limit {
+			continue
+		}
+		classes[i] = q.class(t, now)
+	}
+
+	chosen, chosenPass := q.choose(q.items, classes, q.pass)
+	if chosen == -1 {
+		return nil
+	}
+
+	t := q.items[chosen]
+	owner := q.owner(t)
+	q.virtual = chosenPass
+	q.passes[owner] = chosenPass + 1/q.fairness.Weight(owner)
+	for o, p := range q.passes {
+		if p <= q.virtual {
+			delete(q.passes, o)
+		}
+	}
+
+	q.items = append(q.items[:chosen], q.items[chosen+1:]...)
+	q.running[t.Id] = t
+	q.started[t.Id] = now
+	q.perService[t.Service]++
+	q.working = true
+
 	queueSize.Dec()
-	q.logger.Info("Queue dequeue")
-	return q.items.Dequeue()
+	queueRunning.Inc()
+	q.logger.Info("Queue dequeue", zap.String("id", t.Id.String()), zap.String("owner", owner))
+	return t
 }
 
-// DequeueWhile start maxDequeue workers while the queue is not empty
-func (q *Queue) DequeueWhile() {
-	for q.items.Head() != nil {
-		item := q.dequeue()
+// choose, among the eligible items (the keys of classes), the highest class,
+// then the item of the owner with the lowest pass. Returns -1 if no item is eligible.
+func (q *Queue) choose(items []*task.Task, classes map[int]int, pass func(owner string) float64) (int, float64) {
+	highest := 0
+	first := true
+	for _, class := range classes {
+		if first || class > highest {
+			highest = class
+			first = false
+		}
+	}
 
-		t, ok := item.(*task.Task)
-		if !ok {
-			fmt.Println("error when casting item to task")
+	chosen := -1
+	var chosenPass float64
+	seen := make(map[string]bool)
+	for i, t := range items {
+		if class, eligible := classes[i]; !eligible || class != highest {
 			continue
 		}
+		owner := q.owner(t)
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		p := pass(owner)
+		if chosen == -1 || p < chosenPass {
+			chosen = i
+			chosenPass = p
+		}
+	}
+	return chosen, chosenPass
+}
 
-		ret := -1
+// release the run slot used by a task
+func (q *Queue) release(t *task.Task) {
+	q.Lock()
+	defer q.Unlock()
+	defer q.checkDrained()
 
-		t.State = task.Running
-		err := q.storage.Upsert(t)
-		// FIXME: handle err
-		if err != nil {
-			fmt.Println(err)
+	delete(q.running, t.Id)
+	delete(q.canceled, t.Id)
+	delete(q.enqueued, t.Id)
+	delete(q.started, t.Id)
+	q.perService[t.Service]--
+	if q.perService[t.Service] <= 0 {
+		delete(q.perService, t.Service)
+	}
+	queueRunning.Dec()
+
+	if len(q.running) == 0 {
+		q.working = false
+		if len(q.items) == 0 {
+			// nobody is forced to wait for the end of a batch
+			select {
+			case q.BatchEnded <- true:
+			default:
+			}
+		}
+	}
+}
+
+// checkDrained ends a drain when no task is running. The queue must be locked.
+func (q *Queue) checkDrained() {
+	if q.state != Draining || len(q.running) > 0 {
+		return
+	}
+	q.state = Drained
+	close(q.drained)
+	go q.publishControl(event.Control{
+		Queue:       string(q.state),
+		Maintenance: q.maintenance,
+	})
+}
+
+// DequeueWhile starts a worker for each item, while the queue is not empty and run slots are available.
+// Nothing runs locally when the runs are left to the remote workers.
+func (q *Queue) DequeueWhile() {
+	if q.remoteOnly {
+		return
+	}
+	for {
+		t := q.dequeue()
+		if t == nil {
 			return
 		}
+		q.dequeued(t)
+		go q.work(t)
+	}
+}
 
-		ret, err = q.runner.Run(t)
-		if err != nil {
-			fmt.Println(err)
+// dequeued journals a task leaving the queue, and measures its wait
+func (q *Queue) dequeued(t *task.Task) {
+	err := q.journal(Record{Op: OpDequeue, Id: t.Id})
+	if err != nil {
+		q.logger.Error("Journal write", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+	q.RLock()
+	enqueued, found := q.enqueued[t.Id]
+	started := q.started[t.Id]
+	q.RUnlock()
+	if found {
+		queueWait.WithLabelValues(t.Service, metrics.Project(t.Project)).Observe(started.Sub(enqueued).Seconds())
+	}
+}
+
+// work runs one task, then looks for the next one
+func (q *Queue) work(t *task.Task) {
+	delay, retry := q.attempt(t)
+	q.end(t, delay, retry)
+}
+
+// end of a run: its slot is released, a failed task waits for its retry, then the next one is looked for
+func (q *Queue) end(t *task.Task, delay time.Duration, retry bool) {
+	defer q.DequeueWhile()
+
+	q.release(t)
+	if retry {
+		q.waitRetry(t, delay)
+	}
+}
+
+// attempt runs a task and saves its outcome, or tells when it must be retried
+func (q *Queue) attempt(t *task.Task) (time.Duration, bool) {
+	l := q.logger.With(zap.String("id", t.Id.String()), zap.String("service", t.Service))
+
+	t.State = task.Running
+	if t.Attempt == 0 {
+		t.Attempt = 1
+	}
+	// the exit code of a previous attempt is not the one of this attempt
+	t.ExitCode = nil
+	err := q.storage.Upsert(t)
+	if err != nil {
+		l.Error("Storage upsert", zap.Error(err))
+		return 0, false
+	}
+
+	ret, err := q.runner.Run(t)
+	return q.conclude(t, ret, err)
+}
+
+// conclude a run with its exit code and its error: saves its outcome, or tells when it must be retried
+func (q *Queue) conclude(t *task.Task, ret int, err error) (time.Duration, bool) {
+	l := q.logger.With(zap.String("id", t.Id.String()), zap.String("service", t.Service))
+
+	q.RLock()
+	by, canceled := q.canceled[t.Id]
+	started, found := q.started[t.Id]
+	q.RUnlock()
+	if !found {
+		started = time.Now()
+	}
+	if canceled {
+		if by != uuid.Nil {
+			t.SupersededBy = &by
 		}
+		addAttempt(t, started, task.Canceled, ret, nil)
+		q.setState(t, task.Canceled, nil)
+		return 0, false
+	}
+	if err != nil {
+		l.Error("Run error", zap.Error(err))
+	}
+	q.recordDuration(t.Service, time.Since(started))
+
+	state := task.Failed
+	if errors.Is(err, run.ErrTimeout) {
+		state = task.TimedOut
+	} else if err == nil {
+		code := ret
+		t.ExitCode = &code
+		state = q.meta(t.Service).ExitCodes.State(ret)
+	}
+	addAttempt(t, started, state, ret, err)
+
+	policy := q.meta(t.Service).Retry
+	if state == task.Failed && policy.Retry(t.Attempt, ret, err) {
+		delay := policy.Delay(t.Attempt)
+		l.Info("Retry", zap.Int("attempt", t.Attempt), zap.Duration("delay", delay))
+		return delay, true
+	}
+	q.setState(t, state, err)
+	return 0, false
+}
+
+// addAttempt to the history of a task
+func addAttempt(t *task.Task, start time.Time, state task.State, exitCode int, err error) {
+	attempt := task.Attempt{
+		Start:    start,
+		End:      time.Now(),
+		State:    state,
+		ExitCode: exitCode,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	t.Attempts = append(t.Attempts, attempt)
+}
+
+// waitRetry puts back a failed task in the queue, after a delay
+func (q *Queue) waitRetry(t *task.Task, delay time.Duration) {
+	t.Attempt++
+	q.ready(t)
+	q.Lock()
+	q.retrying[t.Id] = t
+	q.Unlock()
+	time.AfterFunc(delay, func() {
+		q.requeue(t)
+	})
+}
+
+// ready saves and broadcasts a task waiting again for a run slot
+func (q *Queue) ready(t *task.Task) {
+	t.State = task.Ready
+	err := q.storage.Upsert(t)
+	if err != nil {
+		q.logger.Error("Storage upsert", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+	err = q.Sink.Write(event.Event{
+		Id:    t.Id,
+		State: t.State,
+	})
+	if err != nil {
+		q.logger.Error("Sink write", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+	queueSize.Inc()
+}
+
+// requeue a task waiting for its retry
+func (q *Queue) requeue(t *task.Task) {
+	q.Lock()
+	_, waiting := q.retrying[t.Id]
+	delete(q.retrying, t.Id)
+	env := q.envs[t.Id]
+	q.Unlock()
+	if !waiting {
+		// canceled during the delay
+		return
+	}
+
+	if !q.enqueueAgain(t, env) {
+		return
+	}
+	q.logger.Info("queue retry", zap.String("id", t.Id.String()), zap.Int("attempt", t.Attempt))
+	q.DequeueWhile()
+}
+
+// enqueueAgain prepares a task again and puts it back in the queue, false if it failed
+func (q *Queue) enqueueAgain(t *task.Task, env map[string]string) bool {
+	runnable, err := q.runner.Prepare(t, env, q.runOptions(t.Service))
+	if err != nil {
+		queueSize.Dec()
+		q.setState(t, task.Failed, err)
+		return false
+	}
+	t.Run = runnable
+
+	err = q.journal(Record{
+		Op:  OpEnqueue,
+		Id:  t.Id,
+		Env: env,
+	})
+	if err != nil {
+		q.logger.Error("Journal write", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+
+	q.Lock()
+	q.items = append(q.items, t)
+	q.enqueued[t.Id] = time.Now()
+	q.envs[t.Id] = env
+	q.Unlock()
+	return true
+}
+
+// ObserveEnd counts an ended task, by its final state
+func ObserveEnd(t *task.Task) {
+	taskEnded.WithLabelValues(t.Service, metrics.Project(t.Project), t.State.String()).Inc()
+}
+
+// setState of an ended task, journal it, broadcast it and save it
+func (q *Queue) setState(t *task.Task, state task.State, runErr error) {
+	l := q.logger.With(zap.String("id", t.Id.String()), zap.String("state", state.String()))
+	t.State = state
+	q.Lock()
+	delete(q.envs, t.Id)
+	q.Unlock()
+	ObserveEnd(t)
+	if state == task.Done {
+		q.chain(t)
+	}
+	err := q.journal(Record{Op: OpEnd, Id: t.Id})
+	if err != nil {
+		l.Error("Journal write", zap.Error(err))
+	}
+
+	err = q.Sink.Write(event.Event{
+		Id:           t.Id,
+		State:        t.State,
+		Error:        runErr,
+		SupersededBy: t.SupersededBy,
+	})
+	if err != nil {
+		l.Error("Sink write", zap.Error(err))
+	}
+
+	err = q.storage.Upsert(t)
+	if err != nil {
+		l.Error("Storage upsert", zap.Error(err))
+	}
+}
+
+// supersede removes from the queue the tasks of the item's branch, and flags the running one,
+// following the service's policy. The queue must be locked.
+func (q *Queue) supersede(item *task.Task) []*task.Task {
+	policy := q.meta(item.Service).Supersede
+	if policy != service.SupersedeQueued && policy != service.SupersedeRunning {
+		return nil
+	}
+	sameBranch := func(t *task.Task) bool {
+		return t.Id != item.Id &&
+			t.Service == item.Service &&
+			t.Project == item.Project &&
+			t.Branch == item.Branch
+	}
 
-		if ret == 0 {
-			t.State = task.Done
+	superseded := make([]*task.Task, 0)
+	kept := make([]*task.Task, 0, len(q.items))
+	for _, t := range q.items {
+		if sameBranch(t) {
+			t.SupersededBy = &item.Id
+			superseded = append(superseded, t)
 		} else {
-			t.State = task.Failed
+			kept = append(kept, t)
 		}
-		err = q.Sink.Write(event.Event{
-			Id:    t.Id,
-			State: t.State,
-			Error: err,
-		})
-		// FIXME: handle err
-		if err != nil {
-			fmt.Println(err)
-			return
+	}
+	q.items = kept
+	for id, t := range q.retrying {
+		if sameBranch(t) {
+			t.SupersededBy = &item.Id
+			superseded = append(superseded, t)
+			delete(q.retrying, id)
 		}
+	}
 
-		err = q.storage.Upsert(t)
-		// FIXME: handle err
-		if err != nil {
-			fmt.Println(err)
-			return
+	if policy == service.SupersedeRunning {
+		for id, t := range q.running {
+			if _, found := q.canceled[id]; sameBranch(t) && !found {
+				q.canceled[id] = item.Id
+				if _, leased := q.leases[id]; leased {
+					continue
+				}
+				go func(t *task.Task) {
+					err := q.runner.Cancel(t)
+					if err != nil {
+						q.logger.Warn("Runner cancel", zap.String("id", t.Id.String()), zap.Error(err))
+					}
+				}(t)
+			}
+		}
+	}
+
+	return superseded
+}
+
+// cancelQueued ends a task removed from the queue
+func (q *Queue) cancelQueued(t *task.Task) {
+	q.Lock()
+	delete(q.enqueued, t.Id)
+	q.Unlock()
+	queueSize.Dec()
+	err := q.runner.Cancel(t)
+	if err != nil {
+		q.logger.Warn("Runner cancel", zap.String("id", t.Id.String()), zap.Error(err))
+	}
+	q.setState(t, task.Canceled, nil)
+}
+
+// Cancel a task: a queued task leaves the queue, a running task is stopped
+func (q *Queue) Cancel(id uuid.UUID) error {
+	q.Lock()
+	for i, t := range q.items {
+		if t.Id != id {
+			continue
 		}
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		q.Unlock()
+		q.cancelQueued(t)
+		return nil
+	}
+	if t, found := q.retrying[id]; found {
+		delete(q.retrying, id)
+		q.Unlock()
+		q.cancelQueued(t)
+		return nil
 	}
 
-	q.BatchEnded <- true
+	t, running := q.running[id]
+	if running {
+		q.canceled[id] = uuid.Nil
+	}
+	_, leased := q.leases[id]
+	q.Unlock()
 
-	q.working = false
+	if !running {
+		return ErrTaskNotFound
+	}
+	q.logger.Info("Cancel running task", zap.String("id", id.String()))
+	if leased {
+		// the worker stops it when it renews its lease
+		return nil
+	}
+	// work() saves the Canceled state when the run ends
+	return q.runner.Cancel(t)
 }
@@ -1,14 +1,20 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/docker/go-events"
+	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/run"
+	"github.com/factorysh/microdensity/service"
 	"github.com/factorysh/microdensity/sink"
 	"github.com/factorysh/microdensity/storage"
 	"github.com/factorysh/microdensity/task"
@@ -41,7 +47,7 @@ func TestDeq(t *testing.T) {
 
 	r, err := run.NewRunner("../demo/services", "/tmp/microdensity/volumes", []string{})
 	assert.NoError(t, err)
-	que := NewQueue(store, r, &sink.VoidSink{})
+	que := NewQueue(store, r, &sink.VoidSink{}, nil, &conf.Conf{})
 	snk := &DummyEventLogger{
 		Cpt: &sync.WaitGroup{},
 	}
@@ -81,3 +87,667 @@ func TestDeq(t *testing.T) {
 	//snk.Cpt.Wait()
 
 }
+
+func TestDequeueConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "services-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "slow"), 0755)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "slow", "meta.yml"), []byte("max_concurrent_runs: 1\n"), 0644)
+	assert.NoError(t, err)
+	slow, err := service.NewFolder(filepath.Join(dir, "slow"))
+	assert.NoError(t, err)
+
+	que := NewQueue(nil, nil, &sink.VoidSink{}, map[string]service.Service{
+		"slow": slow,
+	}, &conf.Conf{MaxConcurrentRuns: 3})
+
+	for _, s := range []string{"slow", "slow", "demo", "demo", "demo"} {
+		que.items = append(que.items, &task.Task{
+			Id:      uuid.New(),
+			Service: s,
+		})
+	}
+
+	a := que.dequeue()
+	assert.Equal(t, "slow", a.Service)
+	b := que.dequeue()
+	assert.Equal(t, "demo", b.Service, "slow service is capped")
+	c := que.dequeue()
+	assert.Equal(t, "demo", c.Service)
+	assert.Nil(t, que.dequeue(), "global cap is reached")
+	assert.True(t, que.Working())
+	assert.Equal(t, 2, que.Len())
+
+	que.release(a)
+	d := que.dequeue()
+	assert.Equal(t, "slow", d.Service)
+	assert.Nil(t, que.dequeue())
+
+	que.release(b)
+	que.release(c)
+	que.release(d)
+	assert.Equal(t, "demo", que.dequeue().Service)
+	assert.Equal(t, 0, que.Len())
+}
+
+func TestCancelQueued(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+	r, err := run.NewRunner("../demo/services", filepath.Join(dir, "volumes"), []string{})
+	assert.NoError(t, err)
+
+	snk := &DummyEventLogger{
+		Cpt: &sync.WaitGroup{},
+	}
+	que := NewQueue(store, r, snk, nil, &conf.Conf{})
+
+	tsk := &task.Task{
+		Id:      uuid.New(),
+		Service: "demo",
+		Project: "alice",
+		Branch:  "main",
+		State:   task.Ready,
+	}
+	que.items = append(que.items, tsk)
+
+	snk.Cpt.Add(1)
+	err = que.Cancel(tsk.Id)
+	assert.NoError(t, err)
+	snk.Cpt.Wait()
+	assert.Equal(t, 0, que.Len())
+	assert.Equal(t, task.Canceled, tsk.State)
+
+	stored, err := store.Get(tsk.Id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, task.Canceled, stored.State)
+
+	err = que.Cancel(tsk.Id)
+	assert.Equal(t, ErrTaskNotFound, err)
+}
+
+func TestSupersede(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "services-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "lint"), 0755)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "lint", "meta.yml"), []byte("supersede: queued\n"), 0644)
+	assert.NoError(t, err)
+	lint, err := service.NewFolder(filepath.Join(dir, "lint"))
+	assert.NoError(t, err)
+
+	que := NewQueue(nil, nil, &sink.VoidSink{}, map[string]service.Service{
+		"lint": lint,
+	}, &conf.Conf{})
+
+	mkTask := func(svc, branch string) *task.Task {
+		return &task.Task{
+			Id:      uuid.New(),
+			Service: svc,
+			Project: "alice",
+			Branch:  branch,
+		}
+	}
+	first := mkTask("lint", "main")
+	other := mkTask("lint", "feature")
+	demo := mkTask("demo", "main")
+	second := mkTask("lint", "main")
+	que.items = append(que.items, first, other, demo, second)
+
+	last := mkTask("lint", "main")
+	superseded := que.supersede(last)
+	assert.Equal(t, []*task.Task{first, second}, superseded)
+	assert.Equal(t, []*task.Task{other, demo}, que.items)
+	assert.Equal(t, last.Id, *first.SupersededBy)
+
+	assert.Len(t, que.supersede(mkTask("demo", "main")), 0, "demo doesn't supersede")
+
+	err = os.WriteFile(filepath.Join(dir, "lint", "meta.yml"), []byte("supersede: sometimes\n"), 0644)
+	assert.NoError(t, err)
+	_, err = service.NewFolder(filepath.Join(dir, "lint"))
+	assert.Error(t, err)
+}
+
+func TestFairness(t *testing.T) {
+	mkTask := func(project string) *task.Task {
+		return &task.Task{
+			Id:      uuid.New(),
+			Service: "demo",
+			Project: url.PathEscape(project),
+		}
+	}
+	order := func(que *Queue) []string {
+		owners := make([]string, 0)
+		for {
+			tsk := que.dequeue()
+			if tsk == nil {
+				return owners
+			}
+			owners = append(owners, que.owner(tsk))
+			que.release(tsk)
+		}
+	}
+
+	que := NewQueue(nil, nil, &sink.VoidSink{}, nil, &conf.Conf{})
+	for _, p := range []string{"a/matrix", "a/matrix", "a/matrix", "a/matrix", "b/app", "b/app"} {
+		que.items = append(que.items, mkTask(p))
+	}
+	assert.Equal(t, []string{"a/matrix", "b/app", "a/matrix", "b/app", "a/matrix", "a/matrix"}, order(&que))
+
+	que = NewQueue(nil, nil, &sink.VoidSink{}, nil, &conf.Conf{
+		Fairness: conf.FairnessConf{
+			Key: conf.FairByNamespace,
+			Weights: map[string]float64{
+				"a": 2,
+			},
+		},
+	})
+	for _, p := range []string{"a/one", "a/two", "a/three", "a/four", "b/app", "b/app"} {
+		que.items = append(que.items, mkTask(p))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "a", "b", "a"}, order(&que))
+}
+
+func TestPriority(t *testing.T) {
+	que := NewQueue(nil, nil, &sink.VoidSink{}, nil, &conf.Conf{
+		Priority: conf.PriorityConf{
+			Aging: time.Minute,
+		},
+	})
+	feature := &task.Task{Id: uuid.New(), Service: "demo", Project: "a", Priority: 0}
+	old := &task.Task{Id: uuid.New(), Service: "demo", Project: "b", Priority: 0}
+	release := &task.Task{Id: uuid.New(), Service: "demo", Project: "c", Priority: 2}
+	main := &task.Task{Id: uuid.New(), Service: "demo", Project: "d", Priority: 1}
+	now := time.Now()
+	for _, tsk := range []*task.Task{feature, old, release, main} {
+		que.items = append(que.items, tsk)
+		que.enqueued[tsk.Id] = now
+	}
+	// waiting for 3 minutes, old goes up 3 classes
+	que.enqueued[old.Id] = now.Add(-3 * time.Minute)
+
+	for _, expected := range []*task.Task{old, release, main, feature} {
+		tsk := que.dequeue()
+		assert.Equal(t, expected.Id, tsk.Id)
+		que.release(tsk)
+	}
+
+	rules := conf.PriorityRules{Default: 0, Protected: 1, Tag: 2}
+	assert.Equal(t, 0, rules.Class(false, "branch"))
+	assert.Equal(t, 1, rules.Class(true, "branch"))
+	assert.Equal(t, 2, rules.Class(true, "tag"))
+}
+
+func TestSnapshot(t *testing.T) {
+	que := NewQueue(nil, nil, &sink.VoidSink{}, nil, &conf.Conf{
+		MaxConcurrentRuns: 2,
+	})
+	running := &task.Task{Id: uuid.New(), Service: "demo", Project: "a"}
+	a1 := &task.Task{Id: uuid.New(), Service: "demo", Project: "a"}
+	a2 := &task.Task{Id: uuid.New(), Service: "demo", Project: "a"}
+	b1 := &task.Task{Id: uuid.New(), Service: "demo", Project: "b"}
+	now := time.Now()
+	for _, tsk := range []*task.Task{running, a1, a2, b1} {
+		que.items = append(que.items, tsk)
+		que.enqueued[tsk.Id] = now
+	}
+	assert.Equal(t, running.Id, que.dequeue().Id)
+	que.started[running.Id] = now.Add(-time.Minute)
+
+	// no history, no estimation
+	items := que.Snapshot()
+	assert.Len(t, items, 4)
+	assert.Equal(t, running.Id, items[0].Id)
+	assert.Equal(t, "Running", items[0].State)
+	assert.Equal(t, 0, items[0].Position)
+	assert.Nil(t, items[1].ETA)
+
+	que.recordDuration("demo", 2*time.Minute)
+	que.recordDuration("demo", 4*time.Minute)
+	items = que.Snapshot()
+	// a already got its turn, b goes first
+	for i, expected := range []*task.Task{b1, a1, a2} {
+		item := items[i+1]
+		assert.Equal(t, expected.Id, item.Id)
+		assert.Equal(t, "Ready", item.State)
+		assert.Equal(t, i+1, item.Position)
+		assert.NotNil(t, item.ETA)
+	}
+	// a free slot starts now, the running one ends in 2 minutes
+	assert.WithinDuration(t, time.Now(), *items[1].ETA, time.Second)
+	assert.WithinDuration(t, now.Add(2*time.Minute), *items[2].ETA, time.Second)
+	assert.WithinDuration(t, now.Add(3*time.Minute), *items[3].ETA, time.Second)
+
+	item, found := que.Waiting(b1.Id)
+	assert.True(t, found)
+	assert.Equal(t, 1, item.Position)
+	_, found = que.Waiting(running.Id)
+	assert.False(t, found)
+}
+
+func TestControl(t *testing.T) {
+	que := NewQueue(nil, nil, &sink.VoidSink{}, nil, &conf.Conf{
+		MaxConcurrentRuns: 2,
+	})
+	running := &task.Task{Id: uuid.New(), Service: "demo", Project: "a"}
+	waiting := &task.Task{Id: uuid.New(), Service: "demo", Project: "b"}
+	que.items = append(que.items, running)
+	assert.Equal(t, running.Id, que.dequeue().Id)
+	que.items = append(que.items, waiting)
+
+	que.Pause()
+	assert.Equal(t, Paused, que.State())
+	assert.Nil(t, que.dequeue())
+
+	que.SetMaintenance(true)
+	assert.True(t, que.Maintenance())
+
+	que.Drain()
+	assert.Equal(t, Draining, que.State())
+	assert.Nil(t, que.dequeue())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	assert.False(t, que.WaitDrained(ctx))
+	cancel()
+
+	done := make(chan bool)
+	go func() {
+		done <- que.WaitDrained(context.Background())
+	}()
+	que.release(running)
+	assert.True(t, <-done)
+	assert.Equal(t, Drained, que.State())
+
+	que.state = Active
+	assert.Equal(t, waiting.Id, que.dequeue().Id)
+	que.release(waiting)
+
+	// a drain interrupted by a pause
+	que.items = append(que.items, running)
+	assert.Equal(t, running.Id, que.dequeue().Id)
+	que.Drain()
+	go func() {
+		done <- que.WaitDrained(context.Background())
+	}()
+	que.Pause()
+	assert.False(t, <-done)
+}
+
+func TestCancelRetrying(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+	r, err := run.NewRunner("../demo/services", filepath.Join(dir, "volumes"), []string{})
+	assert.NoError(t, err)
+
+	snk := &DummyEventLogger{
+		Cpt: &sync.WaitGroup{},
+	}
+	que := NewQueue(store, r, snk, nil, &conf.Conf{})
+
+	tsk := &task.Task{
+		Id:      uuid.New(),
+		Service: "demo",
+		Project: "alice",
+		Branch:  "main",
+		State:   task.Failed,
+		Attempt: 1,
+	}
+
+	snk.Cpt.Add(1)
+	que.waitRetry(tsk, time.Hour)
+	snk.Cpt.Wait()
+	assert.Equal(t, task.Ready, tsk.State)
+	assert.Equal(t, 2, tsk.Attempt)
+
+	snk.Cpt.Add(1)
+	err = que.Cancel(tsk.Id)
+	assert.NoError(t, err)
+	snk.Cpt.Wait()
+	assert.Equal(t, task.Canceled, tsk.State)
+	assert.Len(t, que.retrying, 0)
+
+	// the end of the delay does nothing
+	que.requeue(tsk)
+	assert.Equal(t, 0, que.Len())
+}
+
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+	r, err := run.NewRunner("../demo/services", filepath.Join(dir, "volumes"), []string{})
+	assert.NoError(t, err)
+
+	que := NewQueue(store, r, &sink.VoidSink{}, nil, &conf.Conf{
+		Workers: conf.WorkersConf{
+			RemoteOnly: true,
+		},
+	})
+	done := &task.Task{Id: uuid.New(), Service: "demo", Project: "alice", Branch: "main"}
+	lost := &task.Task{Id: uuid.New(), Service: "demo", Project: "bob", Branch: "main"}
+	canceled := &task.Task{Id: uuid.New(), Service: "demo", Project: "carol", Branch: "main"}
+	for _, tsk := range []*task.Task{done, lost, canceled} {
+		que.items = append(que.items, tsk)
+		que.enqueued[tsk.Id] = time.Now()
+		que.envs[tsk.Id] = map[string]string{"HELLO": "World"}
+	}
+	// nothing runs locally
+	que.DequeueWhile()
+	assert.Equal(t, 3, que.Len())
+
+	l := que.Lease("w1")
+	assert.NotNil(t, l)
+	assert.Equal(t, done.Id, l.Task.Id)
+	assert.Equal(t, "World", l.Env["HELLO"])
+	assert.Equal(t, task.Running, done.State)
+	assert.Equal(t, 1, done.Attempt)
+	// every slot is used
+	assert.Nil(t, que.Lease("w2"))
+
+	_, err = que.Renew(done.Id, "w2")
+	assert.Equal(t, ErrLeaseNotFound, err)
+	_, err = que.Renew(done.Id, "w1")
+	assert.NoError(t, err)
+
+	err = que.Complete(done.Id, "w1", Result{})
+	assert.NoError(t, err)
+	assert.Equal(t, task.Done, done.State)
+
+	l = que.Lease("w2")
+	assert.NotNil(t, l)
+	assert.Equal(t, lost.Id, l.Task.Id)
+	que.expireLeases(time.Now().Add(2 * time.Minute))
+	assert.Len(t, lost.Attempts, 1)
+	assert.Equal(t, task.Interrupted, lost.Attempts[0].State)
+	// too late
+	assert.Equal(t, ErrLeaseNotFound, que.Complete(lost.Id, "w2", Result{}))
+
+	// the expired lease freed its slot
+	l = que.Lease("w1")
+	assert.NotNil(t, l)
+	assert.Equal(t, canceled.Id, l.Task.Id)
+	err = que.Cancel(canceled.Id)
+	assert.NoError(t, err)
+	_, err = que.Renew(canceled.Id, "w1")
+	assert.Equal(t, ErrLeaseCanceled, err)
+	err = que.Complete(canceled.Id, "w1", Result{ExitCode: 137})
+	assert.NoError(t, err)
+	assert.Equal(t, task.Canceled, canceled.State)
+}
+
+// fakeRunner runs the tasks without Docker, a run waits for its exit code when there is a release channel
+type fakeRunner struct {
+	lock     sync.Mutex
+	prepared map[uuid.UUID]map[string]string
+	checked  map[uuid.UUID]map[string]string
+	attached map[uuid.UUID]string
+	inputs   map[uuid.UUID]map[string]string
+	release  chan int
+	// runErr is the error of the runs
+	runErr error
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{
+		prepared: make(map[uuid.UUID]map[string]string),
+		checked:  make(map[uuid.UUID]map[string]string),
+		attached: make(map[uuid.UUID]string),
+		inputs:   make(map[uuid.UUID]map[string]string),
+	}
+}
+
+func (f *fakeRunner) Prepare(t *task.Task, env map[string]string, options run.Options) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.prepared[t.Id] = env
+	return "main", nil
+}
+
+func (f *fakeRunner) Check(t *task.Task, env map[string]string, options run.Options) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.checked[t.Id] = env
+	return "main", nil
+}
+
+func (f *fakeRunner) Attach(t *task.Task, containerID string, options run.Options) error {
+	if containerID == "" {
+		return fmt.Errorf("container of task %s not found", t.Id)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.attached[t.Id] = containerID
+	return nil
+}
+
+func (f *fakeRunner) Run(t *task.Task) (int, error) {
+	if f.runErr != nil {
+		return -1, f.runErr
+	}
+	if f.release == nil {
+		return 0, nil
+	}
+	return <-f.release, nil
+}
+
+func (f *fakeRunner) Cancel(t *task.Task) error {
+	f.Forget(t)
+	return nil
+}
+
+func (f *fakeRunner) Forget(t *task.Task) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.prepared, t.Id)
+}
+
+func (f *fakeRunner) WriteInputs(t *task.Task, files map[string]string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inputs[t.Id] = files
+	return nil
+}
+
+func (f *fakeRunner) Inputs(t *task.Task) (map[string]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.inputs[t.Id], nil
+}
+
+// waitBatch waits for the end of the running tasks
+func waitBatch(t *testing.T, que *Queue) {
+	select {
+	case <-que.BatchEnded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batch never ends")
+	}
+}
+
+func TestReattach(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+
+	r := newFakeRunner()
+	r.release = make(chan int)
+	que := NewQueue(store, r, &sink.VoidSink{}, nil, &conf.Conf{})
+
+	tsk := &task.Task{
+		Id:      uuid.New(),
+		Service: "demo",
+		Project: "alice",
+		Branch:  "main",
+		State:   task.Running,
+		Attempt: 1,
+	}
+	err = que.Reattach(tsk, "")
+	assert.Error(t, err)
+	assert.False(t, que.Working())
+	assert.Len(t, que.running, 0)
+
+	err = que.Reattach(tsk, "c0ffee")
+	assert.NoError(t, err)
+	assert.Equal(t, "c0ffee", r.attached[tsk.Id])
+	assert.True(t, que.Working())
+	que.RLock()
+	assert.Equal(t, tsk, que.running[tsk.Id])
+	assert.Equal(t, 1, que.perService["demo"])
+	que.RUnlock()
+
+	r.release <- 0
+	waitBatch(t, &que)
+	assert.Equal(t, task.Done, tsk.State)
+	assert.Equal(t, 0, *tsk.ExitCode)
+	assert.Equal(t, 1, tsk.Attempt, "a reattached task is the same attempt")
+	assert.False(t, que.Working())
+	assert.Len(t, que.running, 0)
+	assert.Len(t, que.perService, 0)
+
+	stored, err := store.Get(tsk.Id.String())
+	assert.NoError(t, err)
+	assert.Equal(t, task.Done, stored.State)
+}
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(filepath.Join(dir, "data"))
+	assert.NoError(t, err)
+	err = os.Mkdir(filepath.Join(dir, "report"), 0755)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "report", "meta.yml"), []byte(`
+then:
+  - service: demo
+    args:
+      HELLO: NAME
+`), 0644)
+	assert.NoError(t, err)
+	report, err := service.NewFolder(filepath.Join(dir, "report"))
+	assert.NoError(t, err)
+	demo, err := service.NewFolder("../demo/services/demo")
+	assert.NoError(t, err)
+
+	r := newFakeRunner()
+	// the exit codes of the runs, in order
+	r.release = make(chan int, 3)
+	que := NewQueue(store, r, &sink.VoidSink{}, map[string]service.Service{
+		"report": report,
+		"demo":   demo,
+	}, &conf.Conf{})
+
+	mkTask := func() *task.Task {
+		return &task.Task{
+			Id:       uuid.New(),
+			Service:  "report",
+			Project:  "alice",
+			Branch:   "main",
+			Commit:   "8e54b1d8c5f0859370196733feeb00da022adeb5",
+			Args:     map[string]interface{}{"NAME": "Bob", "DEPTH": 2},
+			Priority: 3,
+		}
+	}
+
+	parent := mkTask()
+	r.release <- 0
+	r.release <- 0
+	err = que.Put(parent, nil)
+	assert.NoError(t, err)
+	waitBatch(t, &que)
+
+	assert.Equal(t, task.Done, parent.State)
+	assert.Len(t, parent.Children, 1)
+	child, err := store.Get(parent.Children[0].String())
+	assert.NoError(t, err)
+	assert.Equal(t, "demo", child.Service)
+	assert.Equal(t, task.Done, child.State, "the child is enqueued and runs")
+	assert.Equal(t, parent.Id, *child.Parent)
+	assert.Equal(t, map[string]interface{}{"HELLO": "Bob"}, child.Args)
+	assert.Equal(t, parent.Commit, child.Commit)
+	assert.Equal(t, parent.Priority, child.Priority)
+	r.lock.Lock()
+	assert.Equal(t, "Hello Bob", r.inputs[child.Id]["hello.txt"])
+	r.lock.Unlock()
+	latest, err := store.GetLatest("demo", "alice", "main")
+	assert.NoError(t, err)
+	assert.Equal(t, child.Id, latest.Id)
+
+	// a failed task has no downstream task
+	failed := mkTask()
+	r.release <- 1
+	err = que.Put(failed, nil)
+	assert.NoError(t, err)
+	waitBatch(t, &que)
+	assert.Equal(t, task.Failed, failed.State)
+	assert.Empty(t, failed.Children)
+}
+
+func TestAttemptExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+
+	r := newFakeRunner()
+	r.runErr = fmt.Errorf("docker is gone")
+	que := NewQueue(store, r, &sink.VoidSink{}, nil, &conf.Conf{})
+
+	// the previous attempt exited with 1
+	code := 1
+	tsk := &task.Task{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "alice",
+		Branch:   "main",
+		Attempt:  2,
+		ExitCode: &code,
+	}
+	_, retry := que.attempt(tsk)
+	assert.False(t, retry)
+	assert.Equal(t, task.Failed, tsk.State)
+	assert.Nil(t, tsk.ExitCode, "the runner error has no exit code")
+
+	stored, err := store.Get(tsk.Id.String())
+	assert.NoError(t, err)
+	assert.Nil(t, stored.ExitCode)
+}
+
+func TestPutRemoteOnly(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "data-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := storage.NewFSStore(dir)
+	assert.NoError(t, err)
+
+	r := newFakeRunner()
+	que := NewQueue(store, r, &sink.VoidSink{}, nil, &conf.Conf{
+		Workers: conf.WorkersConf{
+			RemoteOnly: true,
+		},
+	})
+	tsk := &task.Task{Id: uuid.New(), Service: "demo", Project: "alice", Branch: "main"}
+	err = que.Put(tsk, map[string]string{"HELLO": "World"})
+	assert.NoError(t, err)
+	assert.Equal(t, "main", tsk.Run)
+	r.lock.Lock()
+	assert.Len(t, r.prepared, 0, "the worker prepares the run")
+	assert.Equal(t, "World", r.checked[tsk.Id]["HELLO"])
+	r.lock.Unlock()
+
+	l := que.Lease("w1")
+	assert.NotNil(t, l)
+	assert.Equal(t, tsk.Id, l.Task.Id)
+	assert.Equal(t, "World", l.Env["HELLO"])
+}
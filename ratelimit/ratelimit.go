@@ -0,0 +1,132 @@
+package ratelimit
+
+/*
+Token buckets, keyed by names like a project or a user.
+*/
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+)
+
+// sweepEvery is the number of calls between two removals of full buckets
+const sweepEvery = 1000
+
+// Key of a bucket, with its limit
+type Key struct {
+	Name  string
+	Limit conf.RateLimit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  conf.RateLimit
+}
+
+// refill the bucket, at this time
+func (b *bucket) refill(now time.Time) {
+	burst := float64(b.limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))/float64(b.limit.Every))
+	b.last = now
+}
+
+// full bucket doesn't need to be kept
+func (b *bucket) full() bool {
+	return b.tokens >= math.Max(1, float64(b.limit.Burst))
+}
+
+// Limiter is a set of token buckets
+type Limiter struct {
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+// New empty Limiter
+func New() *Limiter {
+	return &Limiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from each enabled bucket, or none if one of them is empty.
+// When it's refused, it returns the name of an empty bucket and the delay before a new token.
+func (l *Limiter) Allow(now time.Time, keys ...Key) (bool, string, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	buckets := make([]*bucket, 0, len(keys))
+	refused := ""
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if !key.Limit.Enabled() {
+			continue
+		}
+		b, found := l.buckets[key.Name]
+		if !found || b.limit != key.Limit {
+			b = &bucket{
+				tokens: math.Max(1, float64(key.Limit.Burst)),
+				last:   now,
+				limit:  key.Limit,
+			}
+			l.buckets[key.Name] = b
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) * float64(b.limit.Every))
+			if wait > retryAfter {
+				refused = key.Name
+				retryAfter = wait
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	if refused != "" {
+		return false, refused, retryAfter
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, "", 0
+}
+
+// sweep removes full buckets. The limiter must be locked.
+func (l *Limiter) sweep(now time.Time) {
+	for name, b := range l.buckets {
+		b.refill(now)
+		if b.full() {
+			delete(l.buckets, name)
+		}
+	}
+}
+
+// Refund gives back the token taken by Allow to each enabled bucket, when the request fails afterwards
+func (l *Limiter) Refund(now time.Time, keys ...Key) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, key := range keys {
+		if !key.Limit.Enabled() {
+			continue
+		}
+		b, found := l.buckets[key.Name]
+		if !found || b.limit != key.Limit {
+			continue
+		}
+		b.refill(now)
+		b.tokens = math.Min(math.Max(1, float64(b.limit.Burst)), b.tokens+1)
+	}
+}
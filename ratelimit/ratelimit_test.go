@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllow(t *testing.T) {
+	l := New()
+	now := time.Now()
+	project := Key{Name: "project/factory/demo", Limit: conf.RateLimit{Every: time.Minute, Burst: 2}}
+	user := Key{Name: "user/bob", Limit: conf.RateLimit{Every: 10 * time.Second, Burst: 1}}
+	nolimit := Key{Name: "namespace/factory"}
+
+	ok, _, _ := l.Allow(now, project, user, nolimit)
+	assert.True(t, ok)
+	// the user bucket is empty, the project bucket keeps its token
+	ok, name, retry := l.Allow(now, project, user, nolimit)
+	assert.False(t, ok)
+	assert.Equal(t, "user/bob", name)
+	assert.Equal(t, 10*time.Second, retry)
+
+	now = now.Add(10 * time.Second)
+	ok, _, _ = l.Allow(now, project, user)
+	assert.True(t, ok)
+
+	now = now.Add(10 * time.Second)
+	ok, name, retry = l.Allow(now, project, user)
+	assert.False(t, ok)
+	assert.Equal(t, "project/factory/demo", name)
+	assert.Equal(t, 40*time.Second, retry)
+
+	// other projects have their own buckets
+	other := Key{Name: "project/factory/other", Limit: project.Limit}
+	ok, _, _ = l.Allow(now, other)
+	assert.True(t, ok)
+
+	now = now.Add(time.Hour)
+	l.sweep(now)
+	assert.Len(t, l.buckets, 0)
+}
+
+func TestRefund(t *testing.T) {
+	l := New()
+	now := time.Now()
+	project := Key{Name: "project/factory/demo", Limit: conf.RateLimit{Every: time.Minute, Burst: 1}}
+	nolimit := Key{Name: "namespace/factory"}
+
+	ok, _, _ := l.Allow(now, project, nolimit)
+	assert.True(t, ok)
+	l.Refund(now, project, nolimit)
+	ok, _, _ = l.Allow(now, project, nolimit)
+	assert.True(t, ok)
+	ok, _, _ = l.Allow(now, project, nolimit)
+	assert.False(t, ok)
+
+	// a refund never fills a bucket over its burst
+	l.Refund(now, project)
+	l.Refund(now, project)
+	assert.Equal(t, 1.0, l.buckets[project.Name].tokens)
+}
@@ -0,0 +1,187 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/compose/v2/pkg/api"
+	dtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var _ Runnable = (*AttachedRun)(nil)
+
+// AttachedRun waits for a container started before a restart
+type AttachedRun struct {
+	docker    *client.Client
+	container string
+	id        uuid.UUID
+	logger    *zap.Logger
+	runCtx    context.Context
+	cancel    context.CancelFunc
+	// keepOnFailure leaves the containers and the network of a failed run
+	keepOnFailure bool
+}
+
+// TaskContainers returns the main container of each task, running or not, the newest one for a task
+func TaskContainers(ctx context.Context) (map[uuid.UUID]string, error) {
+	docker, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := docker.ContainerList(ctx, dtypes.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: TaskLabel,
+			},
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("%s=%s", api.OneoffLabel, "True"),
+			},
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[uuid.UUID]string)
+	created := make(map[uuid.UUID]int64)
+	for _, c := range containers {
+		id, err := uuid.Parse(c.Labels[TaskLabel])
+		if err != nil {
+			continue
+		}
+		if c.Created > created[id] {
+			found[id] = c.ID
+			created[id] = c.Created
+		}
+	}
+	return found, nil
+}
+
+// Prepare does nothing, the container already exists
+func (a *AttachedRun) Prepare(map[string]string, string, uuid.UUID, []string) error {
+	return nil
+}
+
+// Run follows the logs of the container, and waits for its exit code
+func (a *AttachedRun) Run(stdout io.WriteCloser, stderr io.WriteCloser) (int, error) {
+	ctx := a.runCtx
+	defer a.cancel()
+	l := a.logger.With(zap.String("id", a.id.String()), zap.String("container", a.container))
+
+	logs, err := a.docker.ContainerLogs(ctx, a.container, dtypes.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		l.Error("Container logs", zap.Error(err))
+		return -1, err
+	}
+	defer logs.Close()
+	copied := make(chan bool)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, logs)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			l.Warn("Container logs copy", zap.Error(err))
+		}
+		close(copied)
+	}()
+
+	n, err := a.wait(ctx, copied, l)
+	if a.keepOnFailure && (err != nil || n != 0) {
+		l.Info("Containers kept after a failure")
+		return n, err
+	}
+	inspect, ierr := a.docker.ContainerInspect(context.Background(), a.container)
+	if ierr != nil {
+		l.Error("Container inspect", zap.Error(ierr))
+		return n, err
+	}
+	// its logs are written, the main container can go too
+	ierr = a.docker.ContainerRemove(context.Background(), a.container, dtypes.ContainerRemoveOptions{})
+	if ierr != nil {
+		l.Warn("Container remove", zap.Error(ierr))
+	}
+	tearDown(a.docker, inspect.Config.Labels[api.ProjectLabel], a.id, l)
+	return n, err
+}
+
+// wait for the end of the container, and of its logs
+func (a *AttachedRun) wait(ctx context.Context, copied chan bool, l *zap.Logger) (int, error) {
+	statusC, errC := a.docker.ContainerWait(ctx, a.container, container.WaitConditionNotRunning)
+	select {
+	case err := <-errC:
+		l.Error("Container wait", zap.Error(err))
+		return -1, err
+	case status := <-statusC:
+		// the end of the logs, or not, it doesn't wait forever
+		select {
+		case <-copied:
+		case <-time.After(5 * time.Second):
+		}
+		if status.Error != nil {
+			return int(status.StatusCode), errors.New(status.Error.Message)
+		}
+		l.Info("End attached run", zap.Int64("return code", status.StatusCode))
+		return int(status.StatusCode), nil
+	}
+}
+
+// Cancel stops the container
+func (a *AttachedRun) Cancel() {
+	err := stopTaskContainers(context.Background(), a.docker, a.id.String(), 10*time.Second)
+	if err != nil {
+		a.logger.Error("Stop containers", zap.String("id", a.id.String()), zap.Error(err))
+	}
+	a.cancel()
+}
+
+// Attach a task to its container, started before a restart
+func (r *Runner) Attach(t *task.Task, containerID string, options Options) error {
+	r.lock.RLock()
+	_, found := r.tasks[t.Id]
+	r.lock.RUnlock()
+	if found {
+		return fmt.Errorf("task with id `%s` already prepared", t.Id)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	docker, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return err
+	}
+
+	attached := &AttachedRun{
+		docker:        docker,
+		container:     containerID,
+		id:            t.Id,
+		logger:        logger,
+		keepOnFailure: options.KeepOnFailure,
+	}
+	attached.runCtx, attached.cancel = context.WithCancel(context.Background())
+
+	r.lock.Lock()
+	r.tasks[t.Id] = &Context{
+		task:    t,
+		run:     attached,
+		options: options,
+	}
+	r.lock.Unlock()
+	return nil
+}
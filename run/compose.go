@@ -8,7 +8,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"os/user"
@@ -17,7 +19,9 @@ import (
 	"github.com/compose-spec/compose-go/types"
 	"github.com/docker/compose/v2/pkg/api"
 	"github.com/docker/compose/v2/pkg/compose"
+	dtypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
+	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/volumes"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -26,25 +30,64 @@ import (
 
 var _ Runnable = (*ComposeRun)(nil)
 
+// cpuPeriod is the CFS period of the CPU quotas, in microseconds
+const cpuPeriod = 100000
+
 type ComposeRun struct {
 	home    string
 	details *types.ConfigDetails
 	service api.Service
+	docker  *client.Client
 	run     string
 	name    string
 	id      uuid.UUID
 	runCtx  context.Context
+	cancel  context.CancelFunc
 	project *types.Project
 	logger  *zap.Logger
+	limits  conf.LimitsConf
+	applied map[string]conf.Limits
+	network NetworkPolicy
+	hosts   []string
+	// keepOnFailure leaves the containers and the network of a failed run
+	keepOnFailure bool
+	// started is set by Run, a queued run has nothing to stop
+	started int32
 }
 
 func (c *ComposeRun) Id() uuid.UUID {
 	return c.id
 }
 
+// Cancel the run, stopping its container and its dependencies
 func (c *ComposeRun) Cancel() {
-	_, cancelFunc := context.WithCancel(c.runCtx)
-	cancelFunc()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.project == nil || atomic.LoadInt32(&c.started) == 0 {
+		return
+	}
+	l := c.logger.With(
+		zap.String("name", c.project.Name),
+		zap.String("id", c.id.String()),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := stopTaskContainers(ctx, c.docker, c.id.String(), 10*time.Second)
+	if err != nil {
+		l.Error("Stop task containers", zap.Error(err))
+		return
+	}
+
+	// the dependencies belong to the task's own compose project
+	err = c.service.Stop(ctx, c.project, api.StopOptions{})
+	if err != nil {
+		l.Error("Stop dependencies", zap.Error(err))
+		return
+	}
+	l.Info("Canceled")
 }
 
 func NewComposeRun(home string, env map[string]string) (*ComposeRun, error) {
@@ -81,17 +124,8 @@ func NewComposeRun(home string, env map[string]string) (*ComposeRun, error) {
 	l = l.With(zap.String("project", project.Name))
 
 	srv := compose.NewComposeService(docker, dockercfg)
-	grph := compose.NewGraph(project.Services, compose.ServiceStopped)
-	roots := grph.Roots()
-	if len(roots) == 0 {
-		return nil, errors.New("There is no roots")
-	}
-	if len(roots) > 1 {
-		rr := make([]string, len(roots))
-		for i, r := range roots {
-			rr[i] = r.Service
-		}
-		err = fmt.Errorf("i need only one root not %v", rr)
+	main, err := mainService(project)
+	if err != nil {
 		l.Error("Compose graph error", zap.Error(err))
 		return nil, err
 	}
@@ -99,31 +133,61 @@ func NewComposeRun(home string, env map[string]string) (*ComposeRun, error) {
 	// FIXME name is project.Name ?
 	_, name := path.Split(strings.TrimSuffix(home, "/"))
 
-	// use default compose network name
-	networkName := fmt.Sprintf("%s_default", name)
-	err = ensureNetwork(docker, networkName)
-	if err != nil {
-		l.Error("Ensure network", zap.Error(err))
-		return nil, err
-	}
-	l.Info("Ensure Network", zap.String("name", networkName))
-
 	return &ComposeRun{
 		home:    home,
 		details: details,
 		service: srv,
-		run:     roots[0].Service,
+		docker:  docker,
+		run:     main,
 		name:    name,
 		logger:  logger,
 	}, nil
 
 }
 
+// mainService is the root of the compose file, the only service nobody depends on
+func mainService(project *types.Project) (string, error) {
+	grph := compose.NewGraph(project.Services, compose.ServiceStopped)
+	roots := grph.Roots()
+	if len(roots) == 0 {
+		return "", errors.New("There is no roots")
+	}
+	if len(roots) > 1 {
+		rr := make([]string, len(roots))
+		for i, r := range roots {
+			rr[i] = r.Service
+		}
+		return "", fmt.Errorf("i need only one root not %v", rr)
+	}
+	return roots[0].Service, nil
+}
+
+// Release the Docker client of a run which will not start
+func (c *ComposeRun) Release() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	err := c.docker.Close()
+	if err != nil {
+		c.logger.Error("Docker client close", zap.Error(err))
+	}
+}
+
+// Main is the name of the main service, the root of the compose file
+func (c *ComposeRun) Main() string {
+	return c.run
+}
+
+// Applied are the limits of the containers, by compose service
+func (c *ComposeRun) Applied() map[string]conf.Limits {
+	return c.applied
+}
+
 // Prepare set a quiet compose environment, waiting for its wake
 func (c *ComposeRun) Prepare(envs map[string]string, volumesRoot string, id uuid.UUID, hosts []string) error {
 	var err error
 	c.id = id
-	c.runCtx = context.TODO()
+	c.runCtx, c.cancel = context.WithCancel(context.Background())
 	details := types.ConfigDetails{
 		WorkingDir: c.details.WorkingDir,
 		ConfigFiles: []types.ConfigFile{
@@ -134,8 +198,9 @@ func (c *ComposeRun) Prepare(envs map[string]string, volumesRoot string, id uuid
 		},
 		Environment: envs,
 	}
+	// each task is its own compose project, its dependencies are not shared
 	c.project, err = loader.Load(details, func(opt *loader.Options) {
-		opt.Name = c.name
+		opt.Name = fmt.Sprintf("%s_%s", c.name, id)
 		opt.SkipInterpolation = false
 	})
 
@@ -143,6 +208,8 @@ func (c *ComposeRun) Prepare(envs map[string]string, volumesRoot string, id uuid
 		c.logger.Error("compose load", zap.Error(err))
 		return err
 	}
+	c.hosts = hosts
+	c.PrepareNetwork()
 
 	err = c.PrepareVolumes(volumesRoot)
 	if err != nil {
@@ -150,6 +217,12 @@ func (c *ComposeRun) Prepare(envs map[string]string, volumesRoot string, id uuid
 		return err
 	}
 
+	err = c.PrepareInputs(volumesRoot)
+	if err != nil {
+		c.logger.Error("Inputs preparation error", zap.Error(err))
+		return err
+	}
+
 	err = c.PrepareServices(hosts)
 	if err != nil {
 		c.logger.Error("Adding hosts to all services", zap.Error(err))
@@ -164,16 +237,88 @@ func (c *ComposeRun) Prepare(envs map[string]string, volumesRoot string, id uuid
 	return nil
 }
 
+// PrepareNetwork replaces the networks of the project with the task's network, created before the run
+func (c *ComposeRun) PrepareNetwork() {
+	c.project.Networks = types.Networks{
+		"default": types.NetworkConfig{
+			Name:     taskNetwork(c.id),
+			External: types.External{External: true},
+		},
+	}
+	services := make(types.Services, len(c.project.Services))
+	for i, service := range c.project.Services {
+		service.Networks = map[string]*types.ServiceNetworkConfig{
+			"default": nil,
+		}
+		if service.Image == "" {
+			// built images are shared by the tasks, like with the service's project name
+			service.Image = fmt.Sprintf("%s_%s", c.name, service.Name)
+		}
+		services[i] = service
+	}
+	c.project.Services = services
+}
+
+// PrepareServices adds the hosts and the resource limits to every service.
+// On an internal network, hosts are aliases of their containers, connected to the task's network.
 func (c *ComposeRun) PrepareServices(hosts []string) error {
 	services := make(types.Services, len(c.project.Services))
+	c.applied = make(map[string]conf.Limits, len(c.project.Services))
 	for i, service := range c.project.Services {
-		service.ExtraHosts = append(service.ExtraHosts, hosts...)
+		if !c.network.Internal {
+			service.ExtraHosts = append(service.ExtraHosts, hosts...)
+		}
+		limits := c.limits.Apply(askedLimits(service))
+		setLimits(&service, limits)
+		c.applied[service.Name] = limits
 		services[i] = service
 	}
 	c.project.Services = services
 	return nil
 }
 
+// askedLimits are the limits written in the compose file, deploy limits first
+func askedLimits(service types.ServiceConfig) conf.Limits {
+	limits := conf.Limits{
+		CPUs:   float64(service.CPUS),
+		Memory: conf.Bytes(service.MemLimit),
+		Pids:   service.PidsLimit,
+		Shm:    conf.Bytes(service.ShmSize),
+	}
+	if service.CPUQuota > 0 && service.CPUPeriod > 0 {
+		limits.CPUs = float64(service.CPUQuota) / float64(service.CPUPeriod)
+	}
+	if service.Deploy != nil && service.Deploy.Resources.Limits != nil {
+		deploy := service.Deploy.Resources.Limits
+		if cpus, err := strconv.ParseFloat(deploy.NanoCPUs, 64); err == nil && cpus > 0 {
+			limits.CPUs = cpus
+		}
+		if deploy.MemoryBytes > 0 {
+			limits.Memory = conf.Bytes(deploy.MemoryBytes)
+		}
+	}
+	return limits
+}
+
+// setLimits of a service. The CPUs are a quota, compose uses the cpus field only on Windows.
+func setLimits(service *types.ServiceConfig, limits conf.Limits) {
+	service.CPUS = float32(limits.CPUs)
+	service.CPUPeriod = 0
+	service.CPUQuota = 0
+	if limits.CPUs > 0 {
+		service.CPUPeriod = cpuPeriod
+		service.CPUQuota = int64(limits.CPUs * cpuPeriod)
+	}
+	service.MemLimit = types.UnitBytes(limits.Memory)
+	service.PidsLimit = limits.Pids
+	service.ShmSize = types.UnitBytes(limits.Shm)
+	if service.Deploy != nil && service.Deploy.Resources.Limits != nil {
+		// deploy limits win over the service's ones
+		service.Deploy.Resources.Limits.NanoCPUs = ""
+		service.Deploy.Resources.Limits.MemoryBytes = types.UnitBytes(limits.Memory)
+	}
+}
+
 // PrepareVolumes by prepending a custom full path and creating the path on the host
 func (c *ComposeRun) PrepareVolumes(prependPath string) error {
 	for _, svc := range c.project.Services {
@@ -197,6 +342,7 @@ func (c *ComposeRun) PrepareVolumes(prependPath string) error {
 
 // Run a compose service, writing the STDOUT and STDERR outputs, returns the UNIX return code
 func (c *ComposeRun) Run(stdout io.WriteCloser, stderr io.WriteCloser) (int, error) {
+	atomic.StoreInt32(&c.started, 1)
 	return c.runCommand(stdout, stderr, []string{})
 }
 
@@ -223,14 +369,36 @@ func (c *ComposeRun) runCommand(stdout io.WriteCloser, stderr io.WriteCloser, co
 		l.Error("Remove service", zap.Error(err))
 		return -1, err
 	}
+	err = c.pullMissing(c.runCtx)
+	if err != nil {
+		l.Error("Pull images", zap.Error(err))
+		return -1, err
+	}
+
+	// a retried task has the container of its previous attempt
+	err = removeTaskContainers(context.TODO(), c.docker, c.id.String())
+	if err != nil {
+		l.Error("Remove previous attempt", zap.Error(err))
+		return -1, err
+	}
 
-	defer c.Cancel()
+	err = createTaskNetwork(context.TODO(), c.docker, c.id, c.network, c.hosts)
+	if err != nil {
+		l.Error("Create task network", zap.Error(err))
+		tearDown(c.docker, c.project.Name, c.id, l)
+		return -1, err
+	}
+
+	defer c.cancel()
+	// the main container is removed after the run, not by compose:
+	// after a restart, its exit code and its logs are read from it
+	main := fmt.Sprintf("%s_%s_%v", c.name, c.run, c.id)
 	n, err := c.service.RunOneOffContainer(c.runCtx, c.project, api.RunOptions{
-		Name:       fmt.Sprintf("%s_%s_%v", c.project.Name, c.run, c.id),
+		Name:       main,
 		Service:    c.run,
 		Command:    commands,
 		Detach:     false,
-		AutoRemove: false, // FIXME: true
+		AutoRemove: false,
 		Privileged: false,
 		QuietPull:  true,
 		Tty:        false,
@@ -240,7 +408,7 @@ func (c *ComposeRun) runCommand(stdout io.WriteCloser, stderr io.WriteCloser, co
 		User:       u.Uid,
 		NoDeps:     false,
 		Labels: types.Labels{
-			"sh.factory.density.id": c.id.String(),
+			TaskLabel: c.id.String(),
 		},
 		Index: 0,
 	})
@@ -254,9 +422,63 @@ func (c *ComposeRun) runCommand(stdout io.WriteCloser, stderr io.WriteCloser, co
 	} else {
 		l.Error("Run error", zap.Error(err))
 	}
+
+	if c.keepOnFailure && (err != nil || n != 0) {
+		l.Info("Containers kept after a failure", zap.String("project", c.project.Name))
+		return n, err
+	}
+	// its logs are written, the main container can go
+	rerr := c.docker.ContainerRemove(context.Background(), main, dtypes.ContainerRemoveOptions{
+		Force: true,
+	})
+	if rerr != nil && !client.IsErrNotFound(rerr) {
+		l.Warn("Container remove", zap.Error(rerr))
+	}
+	tearDown(c.docker, c.project.Name, c.id, l)
 	return n, err
 }
 
+// pullable are the services with an image to pull, built images are built by compose, not pulled
+func pullable(services types.Services) types.Services {
+	images := types.Services{}
+	for _, s := range services {
+		if s.Image == "" || s.Build != nil {
+			continue
+		}
+		images = append(images, s)
+	}
+	return images
+}
+
+// pullMissing pulls the images not yet here, and times it
+func (c *ComposeRun) pullMissing(ctx context.Context) error {
+	missing := types.Services{}
+	for _, s := range pullable(c.project.Services) {
+		_, _, err := c.docker.ImageInspectWithRaw(ctx, s.Image)
+		if err == nil {
+			continue
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		missing = append(missing, s)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	project := *c.project
+	project.Services = missing
+	chrono := time.Now()
+	err := c.service.Pull(ctx, &project, api.PullOptions{Quiet: true})
+	if err != nil {
+		return err
+	}
+	imagePull.WithLabelValues(c.name).Observe(time.Since(chrono).Seconds())
+	c.logger.Info("Pull images", zap.String("service", c.name), zap.Int("images", len(missing)))
+	return nil
+}
+
 // LoadCompose loads a docker-compose.yml file
 func LoadCompose(home string, env map[string]string) (*types.Project, *types.ConfigDetails, error) {
 	path := filepath.Clean(filepath.Join(home, "docker-compose.yml"))
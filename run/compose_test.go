@@ -2,6 +2,7 @@ package run
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,12 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/compose-spec/compose-go/types"
+	"github.com/docker/compose/v2/pkg/api"
+	dtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/factorysh/microdensity/conf"
 	"github.com/factorysh/microdensity/volumes"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -86,3 +93,133 @@ func TestCompose(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, strings.HasPrefix(string(out), "8.8.8.8"))
 }
+
+func TestLimits(t *testing.T) {
+	limits := conf.LimitsConf{
+		Default: conf.Limits{CPUs: 1, Memory: 512 << 20, Pids: 100},
+		Max:     conf.Limits{CPUs: 2, Memory: 1 << 30, Shm: 64 << 20},
+	}.Override(conf.LimitsConf{
+		Default: conf.Limits{Pids: 200},
+		Max:     conf.Limits{CPUs: 4, Memory: 768 << 20},
+	})
+
+	service := types.ServiceConfig{
+		Name:    "greedy",
+		CPUS:    8,
+		ShmSize: 1 << 30,
+		Deploy: &types.DeployConfig{
+			Resources: types.Resources{
+				Limits: &types.Resource{MemoryBytes: 2 << 30},
+			},
+		},
+	}
+	applied := limits.Apply(askedLimits(service))
+	assert.Equal(t, conf.Limits{CPUs: 2, Memory: 768 << 20, Pids: 200, Shm: 64 << 20}, applied)
+
+	setLimits(&service, applied)
+	assert.Equal(t, int64(cpuPeriod), service.CPUPeriod)
+	assert.Equal(t, int64(2*cpuPeriod), service.CPUQuota)
+	assert.Equal(t, types.UnitBytes(768<<20), service.MemLimit)
+	assert.Equal(t, types.UnitBytes(768<<20), service.Deploy.Resources.Limits.MemoryBytes)
+	assert.Equal(t, int64(200), service.PidsLimit)
+	assert.Equal(t, types.UnitBytes(64<<20), service.ShmSize)
+
+	// a modest service keeps its own limits
+	applied = limits.Apply(askedLimits(types.ServiceConfig{CPUS: 0.5, PidsLimit: 10}))
+	assert.Equal(t, conf.Limits{CPUs: 0.5, Memory: 512 << 20, Pids: 10, Shm: 64 << 20}, applied)
+}
+
+func TestPrepareNetwork(t *testing.T) {
+	id := uuid.New()
+	c := &ComposeRun{
+		name:    "demo",
+		id:      id,
+		network: NetworkPolicy{Internal: true},
+		project: &types.Project{
+			Services: types.Services{
+				{Name: "hello", Image: "busybox"},
+				{Name: "built", Build: &types.BuildConfig{Context: "."}, Networks: map[string]*types.ServiceNetworkConfig{
+					"front": nil,
+				}},
+			},
+			Networks: types.Networks{
+				"front": types.NetworkConfig{Name: "demo_front"},
+			},
+		},
+	}
+	c.PrepareNetwork()
+	assert.Len(t, c.project.Networks, 1)
+	assert.Equal(t, "density_"+id.String(), c.project.Networks["default"].Name)
+	assert.True(t, c.project.Networks["default"].External.External)
+	for _, service := range c.project.Services {
+		assert.Equal(t, []string{"default"}, service.NetworksByPriority())
+	}
+	assert.Equal(t, "demo_built", c.project.Services[1].Image)
+	// the built image has a name, it's not pulled
+	images := pullable(c.project.Services)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "hello", images[0].Name)
+
+	// hosts are reached on the internal network, not with extra hosts
+	err := c.PrepareServices([]string{"browserless:172.17.0.2"})
+	assert.NoError(t, err)
+	assert.Empty(t, c.project.Services[0].ExtraHosts)
+}
+
+func TestTearDown(t *testing.T) {
+	os.MkdirAll(microdensityVolumesRoot, volumes.DirMode)
+	defer func() {
+		os.RemoveAll(microdensityVolumesRoot)
+	}()
+
+	if os.Getenv("CI") != "" {
+		t.Skip("Skipping testing in CI environment")
+	}
+
+	tests := []struct {
+		name          string
+		command       []string
+		keepOnFailure bool
+		kept          bool
+	}{
+		{name: "Success", command: []string{"true"}, keepOnFailure: false, kept: false},
+		{name: "Failure", command: []string{"false"}, keepOnFailure: false, kept: false},
+		{name: "Success kept on failure", command: []string{"true"}, keepOnFailure: true, kept: false},
+		{name: "Failure kept on failure", command: []string{"false"}, keepOnFailure: true, kept: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cr, err := NewComposeRun("../demo/services/demo", map[string]string{})
+			assert.NoError(t, err)
+			cr.keepOnFailure = tc.keepOnFailure
+			id := uuid.New()
+			err = cr.Prepare(map[string]string{}, microdensityVolumesRoot, id, []string{})
+			assert.NoError(t, err)
+			_, err = cr.runCommand(&MockupReaderCloser{&bytes.Buffer{}}, os.Stderr, tc.command)
+			assert.NoError(t, err)
+
+			ctx := context.Background()
+			containers, err := cr.docker.ContainerList(ctx, dtypes.ContainerListOptions{
+				All: true,
+				Filters: filters.NewArgs(filters.KeyValuePair{
+					Key:   "label",
+					Value: fmt.Sprintf("%s=%s", api.ProjectLabel, cr.project.Name),
+				}),
+			})
+			assert.NoError(t, err)
+			_, err = cr.docker.NetworkInspect(ctx, taskNetwork(id), dtypes.NetworkInspectOptions{})
+			if tc.kept {
+				// the main container and its dependency
+				assert.Len(t, containers, 2)
+				assert.NoError(t, err)
+				err = removeTaskContainers(ctx, cr.docker, id.String())
+				assert.NoError(t, err)
+				tearDown(cr.docker, cr.project.Name, id, cr.logger)
+			} else {
+				assert.Len(t, containers, 0)
+				assert.True(t, client.IsErrNotFound(err), "the task network is removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/compose-spec/compose-go/template"
+	"github.com/docker/compose/v2/pkg/api"
+	dtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/volumes"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var _ Runnable = (*ContainerRun)(nil)
+
+// ContainerMain is the name of the main service of a single container service
+const ContainerMain = "main"
+
+// Container is a service run as a single container, without docker compose
+type Container struct {
+	Image   string   `yaml:"image" json:"image"`
+	Command []string `yaml:"command" json:"command,omitempty"`
+	// Volumes are source:target or source:target:ro, sources are relative to the task's volumes
+	Volumes []string          `yaml:"volumes" json:"volumes,omitempty"`
+	Env     map[string]string `yaml:"env" json:"env,omitempty"`
+}
+
+// Volume is a bind mount of a single container service
+type Volume struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ParseVolume reads a source:target or source:target:ro volume
+func ParseVolume(spec string) (Volume, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Volume{}, fmt.Errorf("bad volume %s, source:target is expected", spec)
+	}
+	vol := Volume{
+		Source: parts[0],
+		Target: parts[1],
+	}
+	if len(parts) == 3 {
+		if parts[2] != "ro" && parts[2] != "rw" {
+			return Volume{}, fmt.Errorf("bad volume mode %s in %s", parts[2], spec)
+		}
+		vol.ReadOnly = parts[2] == "ro"
+	}
+	if !path.IsAbs(vol.Target) {
+		return Volume{}, fmt.Errorf("volume target %s is not an absolute path", vol.Target)
+	}
+	return vol, nil
+}
+
+// ContainerRun runs a single container with the Docker API
+type ContainerRun struct {
+	docker  *client.Client
+	spec    Container
+	name    string
+	id      uuid.UUID
+	runCtx  context.Context
+	cancel  context.CancelFunc
+	logger  *zap.Logger
+	limits  conf.LimitsConf
+	applied conf.Limits
+	network NetworkPolicy
+	hosts   []string
+	config  *container.Config
+	host    *container.HostConfig
+	// keepOnFailure leaves the container and the network of a failed run
+	keepOnFailure bool
+	// started is set by Run, a queued run has nothing to stop
+	started int32
+}
+
+// NewContainerRun builds the run of a single container service
+func NewContainerRun(home string, spec Container) (*ContainerRun, error) {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+	l := logger.With(zap.String("home", home))
+
+	docker, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		l.Error("Docker client drama", zap.Error(err))
+		return nil, err
+	}
+	_, err = docker.Ping(context.TODO())
+	if err != nil {
+		l.Error("Docker doesn't ping", zap.Error(err))
+		return nil, err
+	}
+
+	_, name := path.Split(strings.TrimSuffix(home, "/"))
+	return &ContainerRun{
+		docker: docker,
+		spec:   spec,
+		name:   name,
+		logger: logger,
+	}, nil
+}
+
+// Main is the name of the main service
+func (c *ContainerRun) Main() string {
+	return ContainerMain
+}
+
+// Release the Docker client of a run which will not start
+func (c *ContainerRun) Release() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	err := c.docker.Close()
+	if err != nil {
+		c.logger.Error("Docker client close", zap.Error(err))
+	}
+}
+
+// Applied are the limits of the container
+func (c *ContainerRun) Applied() map[string]conf.Limits {
+	return map[string]conf.Limits{
+		ContainerMain: c.applied,
+	}
+}
+
+// Prepare the container, its environment is interpolated like a compose file
+func (c *ContainerRun) Prepare(envs map[string]string, volumesRoot string, id uuid.UUID, hosts []string) error {
+	c.id = id
+	c.hosts = hosts
+	c.runCtx, c.cancel = context.WithCancel(context.Background())
+	mapping := func(key string) (string, bool) {
+		v, found := envs[key]
+		return v, found
+	}
+
+	image, err := template.Substitute(c.spec.Image, mapping)
+	if err != nil {
+		return err
+	}
+	command := make([]string, len(c.spec.Command))
+	for i, arg := range c.spec.Command {
+		command[i], err = template.Substitute(arg, mapping)
+		if err != nil {
+			return err
+		}
+	}
+	env := make([]string, 0, len(c.spec.Env))
+	for k, v := range c.spec.Env {
+		value, err := template.Substitute(v, mapping)
+		if err != nil {
+			return err
+		}
+		env = append(env, fmt.Sprintf("%s=%s", k, value))
+	}
+	sort.Strings(env)
+
+	mounts, err := c.prepareMounts(volumesRoot)
+	if err != nil {
+		c.logger.Error("Volumes preparation error", zap.Error(err))
+		return err
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+
+	c.applied = c.limits.Apply(conf.Limits{})
+	c.config = &container.Config{
+		Image: image,
+		Cmd:   command,
+		Env:   env,
+		User:  u.Uid,
+		// like the one-off container of compose, it's found again after a restart
+		Labels: map[string]string{
+			TaskLabel:       id.String(),
+			api.OneoffLabel: "True",
+		},
+	}
+	c.host = &container.HostConfig{
+		NetworkMode: container.NetworkMode(taskNetwork(id)),
+		Mounts:      mounts,
+		ShmSize:     int64(c.applied.Shm),
+		Resources: container.Resources{
+			Memory: int64(c.applied.Memory),
+		},
+	}
+	if c.applied.CPUs > 0 {
+		c.host.CPUPeriod = cpuPeriod
+		c.host.CPUQuota = int64(c.applied.CPUs * cpuPeriod)
+	}
+	if c.applied.Pids > 0 {
+		pids := c.applied.Pids
+		c.host.PidsLimit = &pids
+	}
+	if !c.network.Internal {
+		c.host.ExtraHosts = hosts
+	}
+	return nil
+}
+
+// prepareMounts creates the sources of the volumes, and mounts the input files
+func (c *ContainerRun) prepareMounts(volumesRoot string) ([]mount.Mount, error) {
+	mounts := make([]mount.Mount, 0, len(c.spec.Volumes)+1)
+	for _, spec := range c.spec.Volumes {
+		vol, err := ParseVolume(spec)
+		if err != nil {
+			return nil, err
+		}
+		// the validation of the service refuses it, the input files stay read only
+		if vol.Target == InputTarget {
+			return nil, fmt.Errorf("volume %s hides the input files", spec)
+		}
+		source := filepath.Join(volumesRoot, "volumes", vol.Source)
+		err = os.MkdirAll(source, volumes.DirMode)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   source,
+			Target:   vol.Target,
+			ReadOnly: vol.ReadOnly,
+		})
+	}
+
+	source := filepath.Join(volumesRoot, "volumes", InputDir)
+	_, err := os.Stat(source)
+	if os.IsNotExist(err) {
+		return mounts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(mounts, mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   source,
+		Target:   InputTarget,
+		ReadOnly: true,
+	}), nil
+}
+
+// Run the container, writing the STDOUT and STDERR outputs, returns the UNIX return code
+func (c *ContainerRun) Run(stdout io.WriteCloser, stderr io.WriteCloser) (int, error) {
+	atomic.StoreInt32(&c.started, 1)
+	l := c.logger.With(
+		zap.String("name", c.name),
+		zap.String("image", c.config.Image),
+		zap.String("id", c.id.String()),
+	)
+
+	// a retried task has the container of its previous attempt
+	err := removeTaskContainers(context.TODO(), c.docker, c.id.String())
+	if err != nil {
+		l.Error("Remove previous attempt", zap.Error(err))
+		return -1, err
+	}
+	err = c.pullMissing(c.runCtx)
+	if err != nil {
+		l.Error("Pull image", zap.Error(err))
+		return -1, err
+	}
+	err = createTaskNetwork(context.TODO(), c.docker, c.id, c.network, c.hosts)
+	if err != nil {
+		l.Error("Create task network", zap.Error(err))
+		tearDown(c.docker, "", c.id, l)
+		return -1, err
+	}
+
+	created, err := c.docker.ContainerCreate(c.runCtx, c.config, c.host, nil, nil, fmt.Sprintf("%s_%v", c.name, c.id))
+	if err == nil {
+		err = c.docker.ContainerStart(c.runCtx, created.ID, dtypes.ContainerStartOptions{})
+	}
+	if err != nil {
+		l.Error("Start container", zap.Error(err))
+		tearDown(c.docker, "", c.id, l)
+		return -1, err
+	}
+
+	// the started container is followed like the one of a restart
+	attached := &AttachedRun{
+		docker:        c.docker,
+		container:     created.ID,
+		id:            c.id,
+		logger:        c.logger,
+		runCtx:        c.runCtx,
+		cancel:        c.cancel,
+		keepOnFailure: c.keepOnFailure,
+	}
+	return attached.Run(stdout, stderr)
+}
+
+// pullMissing pulls the image if it's not yet here, and times it
+func (c *ContainerRun) pullMissing(ctx context.Context) error {
+	_, _, err := c.docker.ImageInspectWithRaw(ctx, c.config.Image)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+
+	chrono := time.Now()
+	reader, err := c.docker.ImagePull(ctx, c.config.Image, dtypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+	imagePull.WithLabelValues(c.name).Observe(time.Since(chrono).Seconds())
+	c.logger.Info("Pull image", zap.String("service", c.name), zap.String("image", c.config.Image))
+	return nil
+}
+
+// Cancel the run, stopping its container
+func (c *ContainerRun) Cancel() {
+	if c.cancel == nil {
+		return
+	}
+	if atomic.LoadInt32(&c.started) == 0 {
+		c.cancel()
+		return
+	}
+	err := stopTaskContainers(context.Background(), c.docker, c.id.String(), 10*time.Second)
+	if err != nil {
+		c.logger.Error("Stop containers", zap.String("id", c.id.String()), zap.Error(err))
+	}
+	c.cancel()
+}
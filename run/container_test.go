@@ -0,0 +1,105 @@
+package run
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/factorysh/microdensity/conf"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVolume(t *testing.T) {
+	vol, err := ParseVolume("./data:/data")
+	assert.NoError(t, err)
+	assert.Equal(t, Volume{Source: "./data", Target: "/data"}, vol)
+	vol, err = ParseVolume("./conf:/etc/app:ro")
+	assert.NoError(t, err)
+	assert.True(t, vol.ReadOnly)
+
+	for _, spec := range []string{"./data", ":/data", "./data:data", "./data:/data:rx", "a:/b:ro:x"} {
+		_, err = ParseVolume(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestContainerPrepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "container-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "volumes", InputDir), 0755))
+
+	c := &ContainerRun{
+		spec: Container{
+			Image:   "${IMAGE:-busybox}",
+			Command: []string{"echo", "${WORD}"},
+			Volumes: []string{"./data:/data"},
+			Env:     map[string]string{"B": "b", "A": "${WORD}"},
+		},
+		name: "demo",
+		limits: conf.LimitsConf{
+			Default: conf.Limits{CPUs: 0.5, Pids: 64},
+		},
+		network: NetworkPolicy{Internal: true},
+	}
+	id := uuid.New()
+	err = c.Prepare(map[string]string{"WORD": "hello"}, dir, id, []string{"browserless:172.17.0.2"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "busybox", c.config.Image)
+	assert.Equal(t, []string{"echo", "hello"}, []string(c.config.Cmd))
+	assert.Equal(t, []string{"A=hello", "B=b"}, c.config.Env)
+	assert.Equal(t, id.String(), c.config.Labels[TaskLabel])
+
+	assert.Equal(t, "density_"+id.String(), string(c.host.NetworkMode))
+	assert.Empty(t, c.host.ExtraHosts)
+	assert.Equal(t, int64(cpuPeriod/2), c.host.CPUQuota)
+	assert.Equal(t, int64(64), *c.host.PidsLimit)
+	assert.Equal(t, conf.Limits{CPUs: 0.5, Pids: 64}, c.Applied()[ContainerMain])
+
+	assert.Equal(t, []mount.Mount{
+		{Type: mount.TypeBind, Source: filepath.Join(dir, "volumes", "data"), Target: "/data"},
+		{Type: mount.TypeBind, Source: filepath.Join(dir, "volumes", InputDir), Target: InputTarget, ReadOnly: true},
+	}, c.host.Mounts)
+	_, err = os.Stat(filepath.Join(dir, "volumes", "data"))
+	assert.NoError(t, err)
+
+	// the input files can't be replaced by a writable volume
+	c.spec.Volumes = []string{"./input:" + InputTarget}
+	_, err = c.prepareMounts(dir)
+	assert.Error(t, err)
+}
+
+func TestContainerCancelQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "container-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	docker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer docker.Close()
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://" + docker.Listener.Addr().String()))
+	assert.NoError(t, err)
+
+	c := &ContainerRun{
+		docker: cli,
+		spec:   Container{Image: "busybox"},
+		name:   "demo",
+	}
+	err = c.Prepare(nil, dir, uuid.New(), nil)
+	assert.NoError(t, err)
+
+	// a queued run never started, Docker has nothing to stop
+	c.Cancel()
+	assert.Error(t, c.runCtx.Err())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
@@ -1,19 +1,27 @@
 package run
 
 import (
+	"fmt"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/compose/v2/pkg/api"
 	dtypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
 
+// TaskLabel is the container label holding the task id
+const TaskLabel = "sh.factory.density.id"
+
 func dockerConfig() (*configfile.ConfigFile, error) {
 	dockercfg := &configfile.ConfigFile{}
 	var home string
@@ -57,26 +65,102 @@ func dockerConfig() (*configfile.ConfigFile, error) {
 	return dockercfg, nil
 }
 
-// Lazy network creation
-func ensureNetwork(cli *client.Client, networkName string) error {
-	networks, err := cli.NetworkList(context.Background(), dtypes.NetworkListOptions{
+// stopTaskContainers stops every container labeled with this task id
+func stopTaskContainers(ctx context.Context, cli *client.Client, id string, timeout time.Duration) error {
+	containers, err := cli.ContainerList(ctx, dtypes.ContainerListOptions{
 		Filters: filters.NewArgs(filters.KeyValuePair{
-			Key:   "name",
-			Value: networkName,
-		},
-		)})
+			Key:   "label",
+			Value: fmt.Sprintf("%s=%s", TaskLabel, id),
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		err = cli.ContainerStop(ctx, container.ID, &timeout)
+		if err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// removeTaskContainers removes the stopped containers of a previous attempt of a task
+func removeTaskContainers(ctx context.Context, cli *client.Client, id string) error {
+	containers, err := cli.ContainerList(ctx, dtypes.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(filters.KeyValuePair{
+			Key:   "label",
+			Value: fmt.Sprintf("%s=%s", TaskLabel, id),
+		}),
+	})
 	if err != nil {
 		return err
 	}
 
-	if len(networks) == 0 {
-		_, err = cli.NetworkCreate(context.Background(), networkName, dtypes.NetworkCreate{})
+	for _, container := range containers {
+		err = cli.ContainerRemove(ctx, container.ID, dtypes.ContainerRemoveOptions{
+			Force: true,
+		})
 		if err != nil {
 			return err
+		}
+	}
+
+	return nil
+}
 
+// removeDependencies stops and removes the containers of a task's compose project, except its one-off containers
+func removeDependencies(ctx context.Context, cli *client.Client, project string, timeout time.Duration) error {
+	containers, err := cli.ContainerList(ctx, dtypes.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("%s=%s", api.ProjectLabel, project),
+			},
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("%s=False", api.OneoffLabel),
+			},
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		err = cli.ContainerStop(ctx, container.ID, &timeout)
+		if err != nil {
+			return err
+		}
+		err = cli.ContainerRemove(ctx, container.ID, dtypes.ContainerRemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	return err
+	return nil
+}
+
+// tearDown the dependencies and the network of a task, after its run
+func tearDown(cli *client.Client, project string, id uuid.UUID, logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// a single container service has no compose project
+	if project != "" {
+		err := removeDependencies(ctx, cli, project, 10*time.Second)
+		if err != nil {
+			logger.Error("Remove dependencies", zap.Error(err))
+		}
+	}
+	err := removeTaskNetwork(ctx, cli, id)
+	if err != nil {
+		logger.Error("Remove task network", zap.Error(err))
+	}
 }
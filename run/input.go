@@ -0,0 +1,143 @@
+package run
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/compose-spec/compose-go/types"
+	"github.com/factorysh/microdensity/volumes"
+)
+
+const (
+	// InputDir is the folder of the input files, in the task's volumes
+	InputDir = "input"
+	// InputTarget is where the input files are mounted, read only, in every container
+	InputTarget = "/input"
+	// MaxInputSize is the size limit of an input file
+	MaxInputSize = 1 << 20
+	// MaxInputsSize is the size limit of all the input files of a task
+	MaxInputsSize = 10 << 20
+	// inputMaxDeep is the maximum number of folders of an input file path
+	inputMaxDeep = 15
+)
+
+// CheckInputs refuses input files with paths escaping the input folder, or too large
+func CheckInputs(files map[string]string) error {
+	total := 0
+	for name, content := range files {
+		_, err := inputPath(name)
+		if err != nil {
+			return err
+		}
+		if len(content) > MaxInputSize {
+			return fmt.Errorf("input file %s is too large (> %d bytes)", name, MaxInputSize)
+		}
+		total += len(content)
+	}
+	if total > MaxInputsSize {
+		return fmt.Errorf("input files are too large (> %d bytes)", MaxInputsSize)
+	}
+	return nil
+}
+
+// inputPath is the clean relative path of an input file
+func inputPath(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("bad input file name %q", name)
+	}
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("input file %s escapes the input folder", name)
+	}
+	if len(strings.Split(clean, string(filepath.Separator))) > inputMaxDeep {
+		return "", fmt.Errorf("input file %s is too deep (> %d)", name, inputMaxDeep)
+	}
+	return clean, nil
+}
+
+// WriteInputs writes the input files in the input folder of a task's volumes
+func WriteInputs(volumesDir string, files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	err := CheckInputs(files)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(volumesDir, InputDir)
+	for name, content := range files {
+		clean, _ := inputPath(name)
+		pth := filepath.Join(root, clean)
+		err = os.MkdirAll(filepath.Dir(pth), volumes.DirMode)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(pth, []byte(content), 0644) //#nosec
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadInputs reads the input files of a task's volumes, nil without input folder
+func ReadInputs(volumesDir string) (map[string]string, error) {
+	root := filepath.Join(volumesDir, InputDir)
+	_, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	files := make(map[string]string)
+	err = filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, pth)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(pth) //#nosec
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// PrepareInputs mounts the input folder, read only, in every service which doesn't use its target
+func (c *ComposeRun) PrepareInputs(prependPath string) error {
+	source := filepath.Join(prependPath, "volumes", InputDir)
+	_, err := os.Stat(source)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, svc := range c.project.Services {
+		used := false
+		for _, vol := range svc.Volumes {
+			if vol.Target == InputTarget {
+				used = true
+			}
+		}
+		if used {
+			continue
+		}
+		c.project.Services[i].Volumes = append(svc.Volumes, types.ServiceVolumeConfig{
+			Type:     "bind",
+			Source:   source,
+			Target:   InputTarget,
+			ReadOnly: true,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package run
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/compose-spec/compose-go/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckInputs(t *testing.T) {
+	assert.NoError(t, CheckInputs(map[string]string{
+		"hello.txt":      "Hello",
+		"conf/app.yml":   "a: b",
+		"./conf/../x.md": "x",
+	}))
+	for _, name := range []string{"", "/etc/passwd", "..", "../x", "conf/../../x", strings.Repeat("a/", 20) + "x"} {
+		assert.Error(t, CheckInputs(map[string]string{name: "x"}), name)
+	}
+	assert.Error(t, CheckInputs(map[string]string{"big": strings.Repeat("x", MaxInputSize+1)}))
+
+	many := make(map[string]string)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"} {
+		many[name] = strings.Repeat("x", MaxInputSize)
+	}
+	assert.Error(t, CheckInputs(many))
+}
+
+func TestInputs(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "volumes-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"hello.txt":    "Hello World",
+		"conf/app.yml": "a: b",
+	}
+	err = WriteInputs(filepath.Join(dir, "volumes"), files)
+	assert.NoError(t, err)
+	read, err := ReadInputs(filepath.Join(dir, "volumes"))
+	assert.NoError(t, err)
+	assert.Equal(t, files, read)
+
+	c := &ComposeRun{
+		project: &types.Project{
+			Services: types.Services{
+				{Name: "hello"},
+				{Name: "own", Volumes: []types.ServiceVolumeConfig{
+					{Type: "bind", Source: "/tmp", Target: InputTarget},
+				}},
+			},
+		},
+	}
+	err = c.PrepareInputs(dir)
+	assert.NoError(t, err)
+	assert.Len(t, c.project.Services[0].Volumes, 1)
+	assert.Equal(t, filepath.Join(dir, "volumes", InputDir), c.project.Services[0].Volumes[0].Source)
+	assert.True(t, c.project.Services[0].Volumes[0].ReadOnly)
+	// its own input
+	assert.Equal(t, "/tmp", c.project.Services[1].Volumes[0].Source)
+}
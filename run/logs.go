@@ -0,0 +1,129 @@
+package run
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamStdout marks the lines written on STDOUT
+	StreamStdout = "stdout"
+	// StreamStderr marks the lines written on STDERR
+	StreamStderr = "stderr"
+)
+
+// LogLine is a line of logs, one JSON object by line in the logs file
+type LogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// Logs writes the STDOUT and STDERR of a run in a JSONL file
+type Logs struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// CreateLogs creates the logs file, the logs of a previous attempt are replaced
+func CreateLogs(path string) (*Logs, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Logs{
+		file:    f,
+		encoder: json.NewEncoder(f),
+	}, nil
+}
+
+// Stream returns a writer of a stream, its lines are written in the logs
+func (l *Logs) Stream(stream string) io.WriteCloser {
+	return &streamWriter{
+		logs:   l,
+		stream: stream,
+	}
+}
+
+func (l *Logs) write(stream string, line []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.encoder.Encode(LogLine{
+		Time:   time.Now(),
+		Stream: stream,
+		Line:   string(line),
+	})
+}
+
+// Close the logs file
+func (l *Logs) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// streamWriter splits a stream in lines, the last one waits for its end of line
+type streamWriter struct {
+	logs    *Logs
+	stream  string
+	pending []byte
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		err := s.logs.write(s.stream, s.pending[:i])
+		s.pending = s.pending[i+1:]
+		if err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Close writes the unfinished line
+func (s *streamWriter) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.logs.write(s.stream, s.pending)
+	s.pending = nil
+	return err
+}
+
+// ReadLogs writes the lines of a logs file to the writer of their stream
+func ReadLogs(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line LogLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			// the last line of a running task can be half written
+			continue
+		}
+		w := stdout
+		if line.Stream == StreamStderr {
+			w = stderr
+		}
+		_, err = io.WriteString(w, line.Line+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,49 @@
+package run
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logs-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "task", task.LogsFile)
+
+	logs, err := CreateLogs(path)
+	assert.NoError(t, err)
+	stdout := logs.Stream(StreamStdout)
+	stderr := logs.Stream(StreamStderr)
+	_, err = stdout.Write([]byte("hello\nwor"))
+	assert.NoError(t, err)
+	_, err = stderr.Write([]byte("oops\n"))
+	assert.NoError(t, err)
+	_, err = stdout.Write([]byte("ld\nbye"))
+	assert.NoError(t, err)
+	assert.NoError(t, stdout.Close())
+	assert.NoError(t, stderr.Close())
+	assert.NoError(t, logs.Close())
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var out, errs bytes.Buffer
+	assert.NoError(t, ReadLogs(f, &out, &errs))
+	assert.Equal(t, "hello\nworld\nbye\n", out.String())
+	assert.Equal(t, "oops\n", errs.String())
+
+	// a new attempt replaces the logs
+	logs, err = CreateLogs(path)
+	assert.NoError(t, err)
+	assert.NoError(t, logs.Close())
+	raw, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Empty(t, raw)
+}
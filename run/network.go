@@ -0,0 +1,106 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	dtypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/google/uuid"
+)
+
+// NetworkPolicy of the network of a task
+type NetworkPolicy struct {
+	// Internal networks have no route outside, only the configured hosts are reachable
+	Internal bool `yaml:"internal" json:"internal"`
+}
+
+// taskNetwork is the name of the network of a task
+func taskNetwork(id uuid.UUID) string {
+	return fmt.Sprintf("density_%s", id)
+}
+
+// createTaskNetwork creates the network of a task, removing the one left by a previous attempt.
+// An internal network gets the containers of the hosts, with their name as alias.
+func createTaskNetwork(ctx context.Context, cli *client.Client, id uuid.UUID, policy NetworkPolicy, hosts []string) error {
+	err := removeTaskNetwork(ctx, cli, id)
+	if err != nil {
+		return err
+	}
+	created, err := cli.NetworkCreate(ctx, taskNetwork(id), dtypes.NetworkCreate{
+		CheckDuplicate: true,
+		Internal:       policy.Internal,
+		Labels: map[string]string{
+			TaskLabel: id.String(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !policy.Internal || len(hosts) == 0 {
+		return nil
+	}
+
+	// hosts are extra_hosts entries, name:ip
+	ips := make(map[string]string, len(hosts))
+	for _, host := range hosts {
+		i := strings.Index(host, ":")
+		if i < 1 {
+			return fmt.Errorf("bad host %s, name:ip is expected", host)
+		}
+		ips[host[i+1:]] = host[:i]
+	}
+	containers, err := cli.ContainerList(ctx, dtypes.ContainerListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if c.NetworkSettings == nil {
+			continue
+		}
+		for _, endpoint := range c.NetworkSettings.Networks {
+			name, found := ips[endpoint.IPAddress]
+			if !found {
+				continue
+			}
+			err = cli.NetworkConnect(ctx, created.ID, c.ID, &network.EndpointSettings{
+				Aliases: []string{name},
+			})
+			if err != nil {
+				return err
+			}
+			delete(ips, endpoint.IPAddress)
+			break
+		}
+	}
+	if len(ips) > 0 {
+		missing := make([]string, 0, len(ips))
+		for ip, name := range ips {
+			missing = append(missing, fmt.Sprintf("%s:%s", name, ip))
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("no container for the hosts %v", missing)
+	}
+	return nil
+}
+
+// removeTaskNetwork disconnects the containers left on the network of a task, and removes it
+func removeTaskNetwork(ctx context.Context, cli *client.Client, id uuid.UUID) error {
+	n, err := cli.NetworkInspect(ctx, taskNetwork(id), dtypes.NetworkInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for container := range n.Containers {
+		err = cli.NetworkDisconnect(ctx, n.ID, container, true)
+		if err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+	return cli.NetworkRemove(ctx, n.ID)
+}
@@ -5,10 +5,15 @@ User defines a task.Task, after validation, it goes to a queue.Queue
 and a run.Runner pick it and run.Runner#Prepare then run.Runner#Run it.
 */
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/metrics"
 	"github.com/factorysh/microdensity/task"
 	"github.com/factorysh/microdensity/volumes"
 	"github.com/google/uuid"
@@ -21,14 +26,44 @@ var (
 		Name: "run_total",
 		Help: "Total tasks run",
 	}, []string{"service", "project"})
+
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "microdensity_run_duration_seconds",
+		Help:    "Duration of the runs, by service",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"service", "project"})
+
+	imagePull = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "microdensity_image_pull_seconds",
+		Help:    "Duration of the pulls of missing images, by service",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"service"})
 )
 
-// Context is a run context, with a STDOUT and a STDERR
+// ErrTimeout is returned when a run lasts longer than its timeout
+var ErrTimeout = errors.New("run timed out")
+
+// Options are the settings of a run, declared by the service
+type Options struct {
+	// Timeout kills the run when time runs out, 0 means no timeout
+	Timeout time.Duration
+	// Limits of the containers
+	Limits conf.LimitsConf
+	// Network policy of the task's network
+	Network NetworkPolicy
+	// KeepOnFailure leaves the containers of a failed run, for debugging
+	KeepOnFailure bool
+	// Container replaces the compose file of the service, nil for a compose service
+	Container *Container
+}
+
+// Context is a run context, with a STDOUT and a STDERR written in the logs of the task
 type Context struct {
-	Stdout io.WriteCloser
-	Stderr io.WriteCloser
-	task   *task.Task
-	run    Runnable
+	Stdout  io.WriteCloser
+	Stderr  io.WriteCloser
+	task    *task.Task
+	run     Runnable
+	options Options
 }
 
 type Runnable interface {
@@ -37,7 +72,19 @@ type Runnable interface {
 	Cancel()
 }
 
+// backend is a Runnable built from the definition of a service
+type backend interface {
+	Runnable
+	// Main is the name of the main service
+	Main() string
+	// Applied are the limits of the containers, by service
+	Applied() map[string]conf.Limits
+	// Release the resources of a prepared run which will not start
+	Release()
+}
+
 type Runner struct {
+	lock        sync.RWMutex
 	tasks       map[uuid.UUID]*Context
 	servicesDir string
 	volumes     *volumes.Volumes
@@ -61,16 +108,19 @@ func NewRunner(servicesDir string, volumesRoot string, hosts []string) (*Runner,
 // Prepare the run
 // Prepare is synchronous, in order to raise an error in the REST endpoint.
 // Prepare checks volumes stuff.
-func (r *Runner) Prepare(t *task.Task, env map[string]string) (string, error) {
+func (r *Runner) Prepare(t *task.Task, env map[string]string, options Options) (string, error) {
 	if t.Id == uuid.Nil {
 		return "", fmt.Errorf("task requires an ID to be prepared")
 	}
 
-	if _, found := r.tasks[t.Id]; found {
+	r.lock.RLock()
+	_, found := r.tasks[t.Id]
+	r.lock.RUnlock()
+	if found {
 		return "", fmt.Errorf("task with id `%s` already prepared", t.Id)
 	}
 
-	runnable, err := NewComposeRun(fmt.Sprintf("%s/%s", r.servicesDir, t.Service), env)
+	runnable, err := r.newBackend(t.Service, env, options)
 	if err != nil {
 		return "", err
 	}
@@ -82,25 +132,141 @@ func (r *Runner) Prepare(t *task.Task, env map[string]string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	t.Limits = runnable.Applied()
 
+	r.lock.Lock()
 	r.tasks[t.Id] = &Context{
-		task:   t,
-		Stdout: &ClosingBuffer{&bytes.Buffer{}},
-		Stderr: &ClosingBuffer{&bytes.Buffer{}},
-		run:    runnable,
+		task:    t,
+		run:     runnable,
+		options: options,
 	}
+	r.lock.Unlock()
 
-	return runnable.run, nil
+	return runnable.Main(), nil
 }
 
-func (r *Runner) Run(t *task.Task) (int, error) {
+// Check the definition of a task's service without Docker, the task runs elsewhere.
+// It returns the name of the main service, like Prepare.
+func (r *Runner) Check(t *task.Task, env map[string]string, options Options) (string, error) {
+	if options.Container != nil {
+		return ContainerMain, nil
+	}
+	project, _, err := LoadCompose(fmt.Sprintf("%s/%s", r.servicesDir, t.Service), env)
+	if err != nil {
+		return "", err
+	}
+	return mainService(project)
+}
+
+// newBackend picks the backend of a service, a single container or a compose file
+func (r *Runner) newBackend(service string, env map[string]string, options Options) (backend, error) {
+	home := fmt.Sprintf("%s/%s", r.servicesDir, service)
+	if options.Container != nil {
+		runnable, err := NewContainerRun(home, *options.Container)
+		if err != nil {
+			return nil, err
+		}
+		runnable.limits = options.Limits
+		runnable.network = options.Network
+		runnable.keepOnFailure = options.KeepOnFailure
+		return runnable, nil
+	}
+
+	runnable, err := NewComposeRun(home, env)
+	if err != nil {
+		return nil, err
+	}
+	runnable.limits = options.Limits
+	runnable.network = options.Network
+	runnable.keepOnFailure = options.KeepOnFailure
+	return runnable, nil
+}
+
+// WriteInputs writes the input files of a task in its volumes
+func (r *Runner) WriteInputs(t *task.Task, files map[string]string) error {
+	return WriteInputs(r.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), "volumes"), files)
+}
 
+// Inputs are the input files of a task, read from its volumes
+func (r *Runner) Inputs(t *task.Task) (map[string]string, error) {
+	return ReadInputs(r.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), "volumes"))
+}
+
+// LogsPath is the path of the logs of a task
+func (r *Runner) LogsPath(t *task.Task) string {
+	return r.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), task.LogsFile)
+}
+
+// Run a prepared task, several tasks can run at the same time
+func (r *Runner) Run(t *task.Task) (int, error) {
+	r.lock.RLock()
 	ctx, found := r.tasks[t.Id]
+	r.lock.RUnlock()
 	if !found {
 		return 0, fmt.Errorf("task with id `%s` not found in runner", t.Id)
 	}
+	defer func() {
+		r.lock.Lock()
+		delete(r.tasks, t.Id)
+		r.lock.Unlock()
+	}()
+
+	logs, err := CreateLogs(r.LogsPath(t))
+	if err != nil {
+		return -1, err
+	}
+	ctx.Stdout = logs.Stream(StreamStdout)
+	ctx.Stderr = logs.Stream(StreamStderr)
+	defer func() {
+		ctx.Stdout.Close()
+		ctx.Stderr.Close()
+		logs.Close()
+	}()
 	defer serviceRun.With(prometheus.Labels{
 		"service": t.Service,
 		"project": t.Project}).Inc()
-	return ctx.run.Run(ctx.Stdout, ctx.Stderr)
+
+	var timedOut int32
+	if ctx.options.Timeout > 0 {
+		timer := time.AfterFunc(ctx.options.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			ctx.run.Cancel()
+		})
+		defer timer.Stop()
+	}
+
+	chrono := time.Now()
+	n, err := ctx.run.Run(ctx.Stdout, ctx.Stderr)
+	runDuration.WithLabelValues(t.Service, metrics.Project(t.Project)).Observe(time.Since(chrono).Seconds())
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return n, ErrTimeout
+	}
+	return n, err
+}
+
+// Cancel a prepared task, stopping it if it is running
+func (r *Runner) Cancel(t *task.Task) error {
+	r.lock.Lock()
+	ctx, found := r.tasks[t.Id]
+	delete(r.tasks, t.Id)
+	r.lock.Unlock()
+	if !found {
+		return fmt.Errorf("task with id `%s` not found in runner", t.Id)
+	}
+	ctx.run.Cancel()
+	return nil
+}
+
+// Forget a prepared task without cancelling it, another process runs it
+func (r *Runner) Forget(t *task.Task) {
+	r.lock.Lock()
+	ctx, found := r.tasks[t.Id]
+	delete(r.tasks, t.Id)
+	r.lock.Unlock()
+	if !found {
+		return
+	}
+	if b, ok := ctx.run.(backend); ok {
+		b.Release()
+	}
 }
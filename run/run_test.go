@@ -0,0 +1,78 @@
+package run
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ Runnable = (*SleepRun)(nil)
+
+// SleepRun waits until it is canceled
+type SleepRun struct {
+	canceled chan bool
+}
+
+func (s *SleepRun) Prepare(map[string]string, string, uuid.UUID, []string) error {
+	return nil
+}
+
+func (s *SleepRun) Run(stdout io.WriteCloser, stderr io.WriteCloser) (int, error) {
+	<-s.canceled
+	return 137, nil
+}
+
+func (s *SleepRun) Cancel() {
+	close(s.canceled)
+}
+
+func TestRunTimeout(t *testing.T) {
+	r, err := NewRunner("../demo/services", "/tmp/microdensity/volumes", []string{})
+	assert.NoError(t, err)
+
+	tsk := &task.Task{
+		Id:      uuid.New(),
+		Service: "waiter",
+	}
+	r.tasks[tsk.Id] = &Context{
+		task:    tsk,
+		run:     &SleepRun{canceled: make(chan bool)},
+		options: Options{Timeout: 50 * time.Millisecond},
+	}
+
+	chrono := time.Now()
+	_, err = r.Run(tsk)
+	assert.Equal(t, ErrTimeout, err)
+	assert.True(t, time.Since(chrono) < time.Second)
+
+	_, err = r.Run(tsk)
+	assert.Error(t, err, "a task is forgotten after its run")
+}
+
+func TestCheck(t *testing.T) {
+	r, err := NewRunner("../demo/services", "/tmp/microdensity/volumes", []string{})
+	assert.NoError(t, err)
+
+	tsk := &task.Task{
+		Id:      uuid.New(),
+		Service: "demo",
+	}
+	main, err := r.Check(tsk, map[string]string{"HELLO": "Bob"}, Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", main)
+
+	main, err = r.Check(tsk, nil, Options{Container: &Container{Image: "busybox"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ContainerMain, main)
+
+	tsk.Service = "wombat"
+	_, err = r.Check(tsk, nil, Options{})
+	assert.Error(t, err)
+	// nothing is prepared
+	r.Forget(tsk)
+	assert.Len(t, r.tasks, 0)
+}
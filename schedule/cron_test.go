@@ -0,0 +1,60 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{
+		"* * * * *",
+		"*/5 * * * *",
+		"0 3 * * 1-5",
+		"0,30 8-18/2 1,15 * 7",
+		"@daily",
+	} {
+		_, err := ParseCron(expr)
+		assert.NoError(t, err, expr)
+	}
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@never",
+	} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2021, 12, 1, 10, 17, 42, 0, time.UTC)
+	for expr, next := range map[string]time.Time{
+		"* * * * *":    time.Date(2021, 12, 1, 10, 18, 0, 0, time.UTC),
+		"*/15 * * * *": time.Date(2021, 12, 1, 10, 30, 0, 0, time.UTC),
+		"0 3 * * *":    time.Date(2021, 12, 2, 3, 0, 0, 0, time.UTC),
+		"@hourly":      time.Date(2021, 12, 1, 11, 0, 0, 0, time.UTC),
+		"@monthly":     time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":    time.Date(2021, 12, 5, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 1-5":  time.Date(2021, 12, 2, 0, 0, 0, 0, time.UTC),
+		// day of month or day of week
+		"0 0 13 * 5": time.Date(2021, 12, 3, 0, 0, 0, 0, time.UTC),
+		"0 0 30 2 *": {},
+	} {
+		assert.Equal(t, next, mustParseCron(t, expr).Next(now), expr)
+	}
+}
+
+func mustParseCron(t *testing.T, expr string) *Cron {
+	c, err := ParseCron(expr)
+	assert.NoError(t, err)
+	return c
+}
@@ -0,0 +1,276 @@
+package schedule
+
+/*
+A schedule runs a service again, for a project branch, at cron times.
+Schedules are JSON files in a folder.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// DirMode is the default dirmode for schedules
+const DirMode fs.FileMode = 0755
+
+// ErrNotFound is returned for an unknown schedule
+var ErrNotFound = errors.New("schedule not found")
+
+// Schedule of a service, for a project branch
+type Schedule struct {
+	Id       uuid.UUID `json:"id"`
+	Service  string    `json:"service"`
+	Project  string    `json:"project"`
+	Branch   string    `json:"branch"`
+	Cron     string    `json:"cron"`
+	Creation time.Time `json:"creation"`
+	// LastRun is the last time this schedule was triggered
+	LastRun time.Time `json:"last_run"`
+	// LastTask is the id of the last task created, or the last error
+	LastTask  *uuid.UUID `json:"last_task,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	cron      *Cron
+}
+
+// Validate a schedule, and parse its cron expression
+func (s *Schedule) Validate() error {
+	if s.Id == uuid.Nil {
+		return errors.New("empty id not allowed")
+	}
+	if s.Service == "" || s.Project == "" || s.Branch == "" {
+		return errors.New("service, project and branch are mandatory")
+	}
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+	s.cron = c
+	return nil
+}
+
+// Next time this schedule must be triggered
+func (s *Schedule) Next() time.Time {
+	last := s.LastRun
+	if last.IsZero() {
+		last = s.Creation
+	}
+	return s.cron.Next(last)
+}
+
+// TriggerFunc creates a task for a schedule, and returns its id
+type TriggerFunc func(*Schedule) (uuid.UUID, error)
+
+// Scheduler stores the schedules and triggers them
+type Scheduler struct {
+	lock      sync.Mutex
+	root      string
+	schedules map[uuid.UUID]*Schedule
+	trigger   TriggerFunc
+	logger    *zap.Logger
+	stop      chan bool
+}
+
+// New scheduler, loading schedules from the root folder
+func New(root string, trigger TriggerFunc) (*Scheduler, error) {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(root, DirMode)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		root:      root,
+		schedules: make(map[uuid.UUID]*Schedule),
+		trigger:   trigger,
+		logger:    logger,
+		stop:      make(chan bool),
+	}
+
+	files, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(root, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var sched Schedule
+		err = json.Unmarshal(raw, &sched)
+		if err != nil {
+			return nil, fmt.Errorf("error with schedule %s: %v", file.Name(), err)
+		}
+		err = sched.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("error with schedule %s: %v", file.Name(), err)
+		}
+		s.schedules[sched.Id] = &sched
+	}
+	logger.Info("Load schedules", zap.String("root", root), zap.Int("schedules", len(s.schedules)))
+
+	return s, nil
+}
+
+func (s *Scheduler) path(id uuid.UUID) string {
+	return filepath.Join(s.root, fmt.Sprintf("%s.json", id.String()))
+}
+
+// save a schedule, the scheduler must be locked
+func (s *Scheduler) save(sched *Schedule) error {
+	raw, err := json.Marshal(sched)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(sched.Id), raw, 0600)
+}
+
+// Add a new schedule, its cron expression must fire
+func (s *Scheduler) Add(sched *Schedule) error {
+	err := sched.Validate()
+	if err != nil {
+		return err
+	}
+	if sched.Next().IsZero() {
+		return fmt.Errorf("cron expression %s never fires", sched.Cron)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err = s.save(sched)
+	if err != nil {
+		return err
+	}
+	s.schedules[sched.Id] = sched
+	return nil
+}
+
+// Delete a schedule
+func (s *Scheduler) Delete(id uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.schedules[id]; !found {
+		return ErrNotFound
+	}
+	err := os.Remove(s.path(id))
+	if err != nil {
+		return err
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+// Get a schedule
+func (s *Scheduler) Get(id uuid.UUID) (*Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sched, found := s.schedules[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	c := *sched
+	return &c, nil
+}
+
+// Filter returns copies of the schedules matching the filter function, oldest first
+func (s *Scheduler) Filter(filterFn func(*Schedule) bool) []*Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	schedules := make([]*Schedule, 0)
+	for _, sched := range s.schedules {
+		if filterFn(sched) {
+			c := *sched
+			schedules = append(schedules, &c)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Creation.Before(schedules[j].Creation)
+	})
+	return schedules
+}
+
+// All schedules
+func (s *Scheduler) All() []*Schedule {
+	return s.Filter(func(*Schedule) bool { return true })
+}
+
+// Tick triggers the schedules due at this time
+func (s *Scheduler) Tick(now time.Time) {
+	s.lock.Lock()
+	due := make([]*Schedule, 0)
+	for _, sched := range s.schedules {
+		next := sched.Next()
+		if !next.IsZero() && !next.After(now) {
+			due = append(due, sched)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, sched := range due {
+		l := s.logger.With(
+			zap.String("schedule", sched.Id.String()),
+			zap.String("service", sched.Service),
+			zap.String("project", sched.Project),
+			zap.String("branch", sched.Branch),
+		)
+		id, err := s.trigger(sched)
+
+		s.lock.Lock()
+		sched.LastRun = now
+		if err != nil {
+			l.Error("Schedule trigger", zap.Error(err))
+			sched.LastTask = nil
+			sched.LastError = err.Error()
+		} else {
+			l.Info("Schedule trigger", zap.String("task", id.String()))
+			sched.LastTask = &id
+			sched.LastError = ""
+		}
+		// the schedule may have been deleted during the trigger
+		if _, found := s.schedules[sched.Id]; found {
+			err = s.save(sched)
+			if err != nil {
+				l.Error("Schedule save", zap.Error(err))
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Start ticking every minute
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			now := time.Now()
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+				s.Tick(time.Now())
+			}
+		}
+	}()
+}
+
+// Stop ticking
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
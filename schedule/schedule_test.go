@@ -0,0 +1,106 @@
+package schedule
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "schedule-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	triggered := make([]string, 0)
+	taskID := uuid.New()
+	trigger := func(s *Schedule) (uuid.UUID, error) {
+		triggered = append(triggered, s.Branch)
+		if s.Branch == "broken" {
+			return uuid.Nil, errors.New("no task to run again")
+		}
+		return taskID, nil
+	}
+
+	s, err := New(dir, trigger)
+	assert.NoError(t, err)
+	assert.Len(t, s.All(), 0)
+
+	creation := time.Date(2021, 12, 1, 10, 17, 0, 0, time.UTC)
+	err = s.Add(&Schedule{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "group%2Fproject",
+		Branch:   "main",
+		Cron:     "0 * * * *",
+		Creation: creation,
+	})
+	assert.NoError(t, err)
+	err = s.Add(&Schedule{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "group%2Fproject",
+		Branch:   "broken",
+		Cron:     "30 * * * *",
+		Creation: creation.Add(time.Second),
+	})
+	assert.NoError(t, err)
+	err = s.Add(&Schedule{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "group%2Fproject",
+		Branch:   "main",
+		Cron:     "every hour",
+		Creation: creation,
+	})
+	assert.Error(t, err)
+	err = s.Add(&Schedule{
+		Id:       uuid.New(),
+		Service:  "demo",
+		Project:  "group%2Fproject",
+		Branch:   "main",
+		Cron:     "0 0 31 2 *",
+		Creation: creation,
+	})
+	assert.Error(t, err, "february 31st never comes")
+
+	s.Tick(creation.Add(10 * time.Minute))
+	assert.Len(t, triggered, 0)
+
+	s.Tick(creation.Add(50 * time.Minute))
+	assert.ElementsMatch(t, []string{"main", "broken"}, triggered)
+
+	all := s.All()
+	assert.Len(t, all, 2)
+	assert.Equal(t, "main", all[0].Branch)
+	assert.Equal(t, &taskID, all[0].LastTask)
+	assert.Equal(t, "", all[0].LastError)
+	assert.Nil(t, all[1].LastTask)
+	assert.Equal(t, "no task to run again", all[1].LastError)
+
+	// already triggered at this time
+	s.Tick(creation.Add(50 * time.Minute))
+	assert.Len(t, triggered, 2)
+
+	// schedules are loaded again from the disk
+	s2, err := New(dir, trigger)
+	assert.NoError(t, err)
+	all2 := s2.All()
+	assert.Len(t, all2, 2)
+	assert.Equal(t, creation.Add(50*time.Minute), all2[0].LastRun.UTC())
+
+	err = s2.Delete(all2[1].Id)
+	assert.NoError(t, err)
+	err = s2.Delete(all2[1].Id)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s2.Get(all2[1].Id)
+	assert.Equal(t, ErrNotFound, err)
+
+	s3, err := New(dir, trigger)
+	assert.NoError(t, err)
+	assert.Len(t, s3.All(), 1)
+}
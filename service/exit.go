@@ -0,0 +1,60 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/factorysh/microdensity/task"
+)
+
+// exitStates are the states an exit code can be mapped to
+var exitStates = map[string]task.State{
+	"done":    task.Done,
+	"warning": task.Warning,
+	"failed":  task.Failed,
+}
+
+// ExitCode is the outcome of an exit code of the main container
+type ExitCode struct {
+	// State of the task: done, warning or failed
+	State string `yaml:"state"`
+	// Status is the text of the status badge, the name of the state by default
+	Status string `yaml:"status"`
+	// Color of the status badge, the color of the state by default
+	Color string `yaml:"color"`
+}
+
+// ExitCodes maps exit codes to task states, 0 is Done and the other codes are Failed
+type ExitCodes map[int]ExitCode
+
+// Validate the states names
+func (e ExitCodes) Validate() error {
+	for code, exit := range e {
+		if _, found := exitStates[exit.State]; !found {
+			return fmt.Errorf("exit code %d: unknown state : %s", code, exit.State)
+		}
+	}
+	return nil
+}
+
+// State of a task ended with this exit code
+func (e ExitCodes) State(code int) task.State {
+	if exit, found := e[code]; found {
+		return exitStates[exit.State]
+	}
+	if code == 0 {
+		return task.Done
+	}
+	return task.Failed
+}
+
+// Badge returns the status and the color of an ended task, empty when the exit code doesn't set them
+func (e ExitCodes) Badge(t *task.Task) (string, string) {
+	if t.ExitCode == nil {
+		return "", ""
+	}
+	exit, found := e[*t.ExitCode]
+	if !found || exitStates[exit.State] != t.State {
+		return "", ""
+	}
+	return exit.Status, exit.Color
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/factorysh/microdensity/task"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCodes(t *testing.T) {
+	var none ExitCodes
+	assert.Equal(t, task.Done, none.State(0))
+	assert.Equal(t, task.Failed, none.State(2))
+
+	codes := ExitCodes{
+		2: {State: "warning", Status: "warnings found", Color: "#ffa500"},
+		3: {State: "done"},
+	}
+	assert.NoError(t, codes.Validate())
+	assert.Equal(t, task.Warning, codes.State(2))
+	assert.Equal(t, task.Done, codes.State(3))
+	assert.Equal(t, task.Failed, codes.State(1))
+	assert.Error(t, ExitCodes{2: {State: "Warning!"}}.Validate())
+
+	code := 2
+	status, color := codes.Badge(&task.Task{State: task.Warning, ExitCode: &code})
+	assert.Equal(t, "warnings found", status)
+	assert.Equal(t, "#ffa500", color)
+	// retried or canceled, the state is not the one of the exit code
+	status, _ = codes.Badge(&task.Task{State: task.Canceled, ExitCode: &code})
+	assert.Empty(t, status)
+	status, _ = codes.Badge(&task.Task{State: task.Ready})
+	assert.Empty(t, status)
+}
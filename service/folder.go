@@ -11,6 +11,7 @@ import (
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dop251/goja"
+	"github.com/factorysh/microdensity/run"
 	"github.com/factorysh/microdensity/task"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -31,6 +32,8 @@ type FolderService struct {
 type Arguments struct {
 	Environments map[string]string `json:"environments"`
 	Files        map[string]string `json:"files"`
+	// Priority class of the task, it wins over the priority rules
+	Priority *int `json:"priority"`
 }
 
 type Console struct {
@@ -40,24 +43,10 @@ func (c *Console) Log(args ...interface{}) {
 	spew.Dump(args...)
 }
 
-func NewFolder(_path string) (*FolderService, error) {
-	_path = path.Clean(_path)
-	logger, err := zap.NewProduction()
-	if err != nil {
-		return nil, err
-	}
-	l := logger.With(zap.String("path", _path))
-	stat, err := os.Stat(_path)
-	if err != nil {
-		l.Error("stat", zap.Error(err))
-		return nil, err
-	}
-	if !stat.IsDir() {
-		l.Error("Is not a directory")
-		return nil, fmt.Errorf("%s is not a directory", _path)
-	}
-
+// loadMeta reads the meta.yml file of a service
+func loadMeta(_path string) (Meta, error) {
 	var content []byte
+	var err error
 
 	// loop over possible meta.yml files
 	for _, name := range []string{"meta.yml", "meta.yaml"} {
@@ -71,15 +60,46 @@ func NewFolder(_path string) (*FolderService, error) {
 		}
 	}
 
+	var m Meta
 	if err != nil {
-		return nil, fmt.Errorf("error with path %s: %v", _path, err)
+		return m, fmt.Errorf("error with path %s: %v", _path, err)
 	}
 
-	var m Meta
-
 	err = yaml.Unmarshal(content, &m)
 	if err != nil {
-		return nil, fmt.Errorf("error with path %s: %v", _path, err)
+		return m, fmt.Errorf("error with path %s: %v", _path, err)
+	}
+	err = m.Supersede.Validate()
+	if err != nil {
+		return m, fmt.Errorf("error with path %s: %v", _path, err)
+	}
+	err = m.ExitCodes.Validate()
+	if err != nil {
+		return m, fmt.Errorf("error with path %s: %v", _path, err)
+	}
+	return m, nil
+}
+
+func NewFolder(_path string) (*FolderService, error) {
+	_path = path.Clean(_path)
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+	l := logger.With(zap.String("path", _path))
+	stat, err := os.Stat(_path)
+	if err != nil {
+		l.Error("stat", zap.Error(err))
+		return nil, err
+	}
+	if !stat.IsDir() {
+		l.Error("Is not a directory")
+		return nil, fmt.Errorf("%s is not a directory", _path)
+	}
+
+	m, err := loadMeta(_path)
+	if err != nil {
+		return nil, err
 	}
 
 	_, name := path.Split(_path)
@@ -136,7 +156,11 @@ func (f *FolderService) Validate(args map[string]interface{}) (Arguments, error)
 	defer f.logger.Info("Validate",
 		zap.String("service", f.name),
 		zap.Float64("validation time (µs)", float64(time.Since(chrono))/1000))
-	return f.validate(args)
+	arguments, err := f.validate(args)
+	if err != nil {
+		return arguments, err
+	}
+	return arguments, run.CheckInputs(arguments.Files)
 }
 func (f *FolderService) New(project string, args map[string]interface{}) (uuid.UUID, error) {
 	t := &task.Task{
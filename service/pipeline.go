@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Downstream is a service run after a Done task, for the same project, branch and commit
+type Downstream struct {
+	Service string `yaml:"service"`
+	// Args maps the arguments of the downstream task to the parent's ones.
+	// Without Args, the downstream task gets all the parent's arguments.
+	Args map[string]string `yaml:"args"`
+}
+
+// UnmarshalYAML accepts a service name, or a service with its arguments mapping
+func (d *Downstream) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		d.Service = value.Value
+		return nil
+	}
+	type plain Downstream
+	return value.Decode((*plain)(d))
+}
+
+// Arguments of the downstream task, from the parent's ones
+func (d Downstream) Arguments(parent map[string]interface{}) map[string]interface{} {
+	args := make(map[string]interface{})
+	if d.Args == nil {
+		for k, v := range parent {
+			args[k] = v
+		}
+		return args
+	}
+	for k, from := range d.Args {
+		if v, found := parent[from]; found {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// ValidatePipelines checks that downstream services exist, without loop
+func ValidatePipelines(services map[string]Service) error {
+	for name, svc := range services {
+		for _, d := range svc.Meta().Then {
+			if _, found := services[d.Service]; !found {
+				return fmt.Errorf("service %s: unknown downstream service %s", name, d.Service)
+			}
+		}
+	}
+
+	// depth first search, a service seen again in the current path is a loop
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("service %s is its own downstream", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, d := range services[name].Meta().Then {
+			err := visit(d.Service)
+			if err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+	for name := range services {
+		err := visit(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestPipeline(t *testing.T) {
+	var m Meta
+	err := yaml.Unmarshal([]byte(`
+then:
+  - summary
+  - service: publish
+    args:
+      target: url
+`), &m)
+	assert.NoError(t, err)
+	assert.Len(t, m.Then, 2)
+	assert.Equal(t, "summary", m.Then[0].Service)
+	assert.Equal(t, "publish", m.Then[1].Service)
+
+	parent := map[string]interface{}{"url": "https://example.com", "depth": 2}
+	assert.Equal(t, parent, m.Then[0].Arguments(parent))
+	assert.Equal(t, map[string]interface{}{"target": "https://example.com"}, m.Then[1].Arguments(parent))
+
+	services := map[string]Service{
+		"report":  &FolderService{meta: m},
+		"summary": &FolderService{},
+		"publish": &FolderService{},
+	}
+	assert.NoError(t, ValidatePipelines(services))
+
+	services["publish"] = &FolderService{meta: Meta{Then: []Downstream{{Service: "report"}}}}
+	assert.Error(t, ValidatePipelines(services))
+
+	delete(services, "summary")
+	assert.Error(t, ValidatePipelines(services))
+}
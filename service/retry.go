@@ -0,0 +1,46 @@
+package service
+
+import "time"
+
+// RetryPolicy runs a failed task again, after a delay
+type RetryPolicy struct {
+	// Retries is the number of runs after the first one, 0 means no retry
+	Retries int `yaml:"retries"`
+	// Backoff is the delay before the first retry, doubled for each next one
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff caps the delay, 0 means no cap
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// ExitCodes are retried too, runner errors are always retried
+	ExitCodes []int `yaml:"exit_codes"`
+}
+
+// Retry tells if the attempt, starting at 1, must be retried
+func (r RetryPolicy) Retry(attempt int, exitCode int, err error) bool {
+	if attempt > r.Retries {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, code := range r.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay before the retry of the attempt, starting at 1
+func (r RetryPolicy) Delay(attempt int) time.Duration {
+	delay := r.Backoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if r.MaxBackoff > 0 && delay >= r.MaxBackoff {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && delay > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return delay
+}
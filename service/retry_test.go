@@ -0,0 +1,30 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var none RetryPolicy
+	assert.False(t, none.Retry(1, 1, errors.New("pull error")))
+
+	policy := RetryPolicy{
+		Retries:    2,
+		Backoff:    10 * time.Second,
+		MaxBackoff: 30 * time.Second,
+		ExitCodes:  []int{137},
+	}
+	assert.True(t, policy.Retry(1, -1, errors.New("pull error")))
+	assert.True(t, policy.Retry(2, 137, nil))
+	assert.False(t, policy.Retry(3, 137, nil))
+	assert.False(t, policy.Retry(1, 1, nil))
+
+	assert.Equal(t, 10*time.Second, policy.Delay(1))
+	assert.Equal(t, 20*time.Second, policy.Delay(2))
+	assert.Equal(t, 30*time.Second, policy.Delay(3))
+	assert.Equal(t, 30*time.Second, policy.Delay(40))
+}
@@ -1,6 +1,13 @@
 package service
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/run"
+	"github.com/google/uuid"
+)
 
 type Service interface {
 	// Validate the input coming from HTTP Body as a JSON, and fight against XSS
@@ -21,8 +28,64 @@ type Service interface {
 	Meta() Meta
 }
 
+// SupersedePolicy tells which older tasks of a branch are canceled by a newer one
+type SupersedePolicy string
+
+const (
+	// SupersedeNever keeps every task, it's the default
+	SupersedeNever SupersedePolicy = "never"
+	// SupersedeQueued cancels the queued tasks of the branch
+	SupersedeQueued SupersedePolicy = "queued"
+	// SupersedeRunning cancels the queued tasks of the branch, and stops the running one
+	SupersedeRunning SupersedePolicy = "running"
+)
+
+// Validate the policy name
+func (s SupersedePolicy) Validate() error {
+	switch s {
+	case "", SupersedeNever, SupersedeQueued, SupersedeRunning:
+		return nil
+	}
+	return fmt.Errorf("unknown supersede policy : %s", s)
+}
+
 // Meta contains metadata about the linked service
 type Meta struct {
 	Description       string `yaml:"description"`
 	UserDockerCompose bool   `yaml:"user_docker_compose"`
+	// MaxConcurrentRuns caps the number of running tasks of this service, 0 means no cap
+	MaxConcurrentRuns int `yaml:"max_concurrent_runs"`
+	// Timeout kills the run when time runs out, 0 means the server's default
+	Timeout time.Duration `yaml:"timeout"`
+	// Supersede is the policy applied to older tasks of a branch when a newer one is posted
+	Supersede SupersedePolicy `yaml:"supersede"`
+	// Priority rules replace the server's rules
+	Priority *conf.PriorityRules `yaml:"priority"`
+	// RateLimit replaces the server's limits, buckets of this service are not shared with other services
+	RateLimit *conf.RateLimitConf `yaml:"rate_limit"`
+	// Retry failed runs
+	Retry RetryPolicy `yaml:"retry"`
+	// Then are the services run after a Done task
+	Then []Downstream `yaml:"then"`
+	// Limits of the containers, with the server's limits
+	Limits conf.LimitsConf `yaml:"limits"`
+	// Network policy of the tasks' networks
+	Network run.NetworkPolicy `yaml:"network"`
+	// KeepOnFailure leaves the containers of a failed run, for debugging
+	KeepOnFailure bool `yaml:"keep_on_failure"`
+	// ExitCodes maps exit codes to task states and badges
+	ExitCodes ExitCodes `yaml:"exit_codes"`
+	// Container replaces the docker-compose.yml file, for a service run as a single container
+	Container *run.Container `yaml:"container"`
+}
+
+// RunOptions are the settings used by the run.Runner
+func (m Meta) RunOptions() run.Options {
+	return run.Options{
+		Timeout:       m.Timeout,
+		Limits:        m.Limits,
+		Network:       m.Network,
+		KeepOnFailure: m.KeepOnFailure,
+		Container:     m.Container,
+	}
 }
@@ -30,7 +30,24 @@ func ValidateServicesDefinitions(servicesDir string) error {
 }
 
 func validateServiceDefinition(path string) error {
-	err := validateImages(path)
+	_, err := os.Stat(filepath.Join(path, "docker-compose.yml"))
+	if os.IsNotExist(err) {
+		// a single container service is defined by its meta.yml
+		m, err := loadMeta(path)
+		if err != nil {
+			return err
+		}
+		if m.Container == nil {
+			return fmt.Errorf("no docker-compose.yml file nor container in meta.yml in directory %s", path)
+		}
+		err = validateContainer(m.Container)
+		if err != nil {
+			return fmt.Errorf("error when validating container in directory %s: %v", path, err)
+		}
+		return nil
+	}
+
+	err = validateImages(path)
 	if err != nil {
 		return err
 	}
@@ -136,4 +153,40 @@ func volumesValidator(p *types.Project) error {
 	return nil
 }
 
+func validateContainer(c *run.Container) error {
+	if c.Image == "" {
+		return fmt.Errorf("container without image")
+	}
+	err := validateImage(c.Image)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range c.Volumes {
+		vol, err := run.ParseVolume(spec)
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(vol.Source, "./") {
+			return fmt.Errorf("found a none relative mount %s", vol.Source)
+		}
+
+		if strings.Contains(vol.Source, "..") {
+			return fmt.Errorf("found a path trying to access a parent directory %s", vol.Source)
+		}
+
+		if len(strings.Split(vol.Source, "/")) > volumeMaxDeep {
+			return fmt.Errorf("path is too %s is too deep (> %d)", vol.Source, volumeMaxDeep)
+		}
+
+		// the input files are mounted read only, by the run
+		if vol.Target == run.InputTarget {
+			return fmt.Errorf("found a mount on the input target %s", vol.Target)
+		}
+	}
+
+	return nil
+}
+
 type validatorFunc func(*types.Project) error
@@ -11,6 +11,8 @@ func TestValidateServiceDefiniton(t *testing.T) {
 	t.Run("valid definition", func(t *testing.T) {
 		err := validateServiceDefinition("../fixtures/services/valids/test")
 		assert.NoError(t, err)
+		err = validateServiceDefinition("../fixtures/services/valids/container")
+		assert.NoError(t, err)
 	})
 
 	t.Run("invalid definition", func(t *testing.T) {
@@ -21,6 +23,8 @@ func TestValidateServiceDefiniton(t *testing.T) {
 		}{
 			{name: "access parent directory", dir: "../fixtures/services/invalids/volumes-parent", errMessage: "error when validating docker-compose.yml file in directory ../fixtures/services/invalids/volumes-parent: found a path trying to access a parent directory ./../cache in service hello"},
 			{name: "absolute path", dir: "../fixtures/services/invalids/absolute-path", errMessage: "error when validating docker-compose.yml file in directory ../fixtures/services/invalids/absolute-path: found a none relative mount /cache in service hello"},
+			{name: "container access parent directory", dir: "../fixtures/services/invalids/container-parent", errMessage: "error when validating container in directory ../fixtures/services/invalids/container-parent: found a path trying to access a parent directory ./../cache"},
+			{name: "container mounts the input target", dir: "../fixtures/services/invalids/container-input", errMessage: "error when validating container in directory ../fixtures/services/invalids/container-input: found a mount on the input target /input"},
 		}
 		for _, tc := range tests {
 			t.Run(tc.name, func(t *testing.T) {
@@ -36,6 +36,7 @@ type Storage interface {
 	SetLatest(*task.Task) error
 	GetLatest(service, project, branch string) (*task.Task, error)
 	GetVolumePath(*task.Task) string
+	GetLogsPath(*task.Task) string
 	EnsureVolumesDir(*task.Task) error
 	Prune(time.Duration, bool) (int64, error)
 }
@@ -157,7 +158,7 @@ func (s *FSStore) Get(id string) (*task.Task, error) {
 	return taskFromJSON(filepath.Join(taskRootPath, taskFile))
 }
 
-// GetByCommit gets the task using the full path from service to commit
+// GetByCommit gets the task using the full path from service to commit, the last run of the commit
 func (s *FSStore) GetByCommit(service, project, branch, commit string, latest bool) (*task.Task, error) {
 
 	// if latest return early
@@ -169,8 +170,8 @@ func (s *FSStore) GetByCommit(service, project, branch, commit string, latest bo
 		return latest, nil
 	}
 
-	// if not latest, do the heavy stuff
-	var t *task.Task
+	// if not latest, do the heavy stuff, a commit can be run several times, the last run wins
+	var found *task.Task
 	basePath := filepath.Join(s.root, service, project, branch)
 	dirs, err := os.ReadDir(basePath)
 	if err != nil {
@@ -178,17 +179,20 @@ func (s *FSStore) GetByCommit(service, project, branch, commit string, latest bo
 	}
 
 	for _, dir := range dirs {
-		t, err = s.Get(dir.Name())
+		t, err := s.Get(dir.Name())
 		if err != nil {
 			continue
 		}
 
-		if t.Commit == commit {
-			return t, nil
+		if t.Commit == commit && (found == nil || t.Creation.After(found.Creation)) {
+			found = t
 		}
 	}
 
-	return nil, fmt.Errorf("task with commit `%s` not found", commit)
+	if found == nil {
+		return nil, fmt.Errorf("task with commit `%s` not found", commit)
+	}
+	return found, nil
 }
 
 // All returns all the tasks for this storage
@@ -277,6 +281,11 @@ func (s *FSStore) GetVolumePath(t *task.Task) string {
 	return filepath.Join(s.taskRootPath(t), volumesDir)
 }
 
+// GetLogsPath is used to get the path of the logs of a task
+func (s *FSStore) GetLogsPath(t *task.Task) string {
+	return filepath.Join(s.taskRootPath(t), task.LogsFile)
+}
+
 // EnsureVolumesDir is used to create required volume dirs
 func (s *FSStore) EnsureVolumesDir(t *task.Task) error {
 	return s.volumes.Create(t)
@@ -100,6 +100,28 @@ func TestDelete(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetByCommit(t *testing.T) {
+	s, err := NewFSStore(defaultTestDir)
+	defer cleanUp()
+	assert.NoError(t, err)
+
+	err = s.Upsert(dummyTask)
+	assert.NoError(t, err)
+	// a scheduled run of the same commit
+	again := *dummyTask
+	again.Id = uuid.New()
+	again.Creation = dummyTask.Creation.Add(time.Hour)
+	err = s.Upsert(&again)
+	assert.NoError(t, err)
+
+	task, err := s.GetByCommit(dummyTask.Service, dummyTask.Project, dummyTask.Branch, dummyTask.Commit, false)
+	assert.NoError(t, err)
+	assert.Equal(t, again.Id, task.Id, "the last run of the commit wins")
+
+	_, err = s.GetByCommit(dummyTask.Service, dummyTask.Project, dummyTask.Branch, "beef", false)
+	assert.Error(t, err)
+}
+
 func TestSetLatest(t *testing.T) {
 	s, err := NewFSStore(defaultTestDir)
 	defer cleanUp()
@@ -5,20 +5,20 @@ Users push task.Task to a queue.Queue
 */
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"io"
 	"regexp"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/factorysh/microdensity/conf"
 	"github.com/google/uuid"
 )
 
 type State int
 
+// LogsFile is the name of the logs of a run, in the task directory
+const LogsFile = "logs.jsonl"
+
 var (
 	sha  = regexp.MustCompile(`^[0-9a-f]+$`)
 	name = regexp.MustCompile(`^[0-9a-zA-Z\-%_]+$`)
@@ -31,10 +31,13 @@ const (
 	Failed
 	Done
 	Interrupted
+	TimedOut
+	// Warning is a run which ended with an exit code mapped to warnings by its service
+	Warning
 )
 
 func (s State) String() string {
-	return []string{"Ready", "Running", "Canceled", "Failed", "Done", "Interrupted"}[s]
+	return []string{"Ready", "Running", "Canceled", "Failed", "Done", "Interrupted", "TimedOut", "Warning"}[s]
 }
 
 type Task struct {
@@ -48,6 +51,33 @@ type Task struct {
 	Creation time.Time              `json:"creation"`
 	Args     map[string]interface{} `json:"Args"`
 	State    State
+	// Priority class, higher classes run first
+	Priority int `json:"priority"`
+	// SupersededBy is the id of the newer task which canceled this one
+	SupersededBy *uuid.UUID `json:"superseded_by,omitempty"`
+	// Schedule is the id of the schedule which created this task
+	Schedule *uuid.UUID `json:"schedule,omitempty"`
+	// Parent is the task which started this downstream task
+	Parent *uuid.UUID `json:"parent,omitempty"`
+	// Children are the downstream tasks started by this task
+	Children []uuid.UUID `json:"children,omitempty"`
+	// Attempt is the number of the current run, starting at 1
+	Attempt int `json:"attempt"`
+	// Attempts are the ended runs
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// ExitCode of the main container, for the last run
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Limits applied to the containers, by compose service
+	Limits map[string]conf.Limits `json:"limits,omitempty"`
+}
+
+// Attempt is a run of a task, and its outcome
+type Attempt struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	State    State     `json:"state"`
+	ExitCode int       `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
 }
 
 func (t *Task) Validate() error {
@@ -65,19 +95,3 @@ func (t *Task) Validate() error {
 	}
 	return nil
 }
-
-// Logs steam logs of the current run
-func (t *Task) Logs(ctx context.Context, follow bool) (io.ReadCloser, error) {
-	mainName := fmt.Sprintf("%s_%s_%v", t.Service, t.Run, t.Id)
-	docker, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return nil, err
-	}
-
-	return docker.ContainerLogs(ctx, mainName, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Timestamps: true,
-		Follow:     follow,
-	})
-}
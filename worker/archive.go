@@ -0,0 +1,108 @@
+package worker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/factorysh/microdensity/volumes"
+)
+
+// Tar writes the files and the folders of dir in a gzipped tar, other kinds of files are skipped
+func Tar(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		if rel == "." || (!info.Mode().IsRegular() && !info.IsDir()) {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(pth) //#nosec
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		err2 := f.Close()
+		if err != nil {
+			return err
+		}
+		return err2
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Untar extracts a gzipped tar in dir, entries escaping dir are refused, other kinds than files and folders are skipped
+func Untar(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("path escape: %s", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, volumes.DirMode)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), volumes.DirMode)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644) //#nosec
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr) //#nosec
+			err2 := f.Close()
+			if err != nil {
+				return err
+			}
+			if err2 != nil {
+				return err2
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarUntar(t *testing.T) {
+	src, err := ioutil.TempDir(os.TempDir(), "tar-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+	err = os.MkdirAll(filepath.Join(src, "data", "empty"), 0755)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(src, "data", "result.txt"), []byte("hello"), 0644)
+	assert.NoError(t, err)
+
+	buff := &bytes.Buffer{}
+	err = Tar(buff, src)
+	assert.NoError(t, err)
+
+	dest, err := ioutil.TempDir(os.TempDir(), "untar-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Untar(buff, dest)
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "data", "result.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+	info, err := os.Stat(filepath.Join(dest, "data", "empty"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestUntarEscape(t *testing.T) {
+	buff := &bytes.Buffer{}
+	gz := gzip.NewWriter(buff)
+	tw := tar.NewWriter(gz)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "../escape.txt",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     1,
+	})
+	assert.NoError(t, err)
+	_, err = tw.Write([]byte("!"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gz.Close())
+
+	dest, err := ioutil.TempDir(os.TempDir(), "untar-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Untar(buff, dest)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dest), "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,314 @@
+package worker
+
+/*
+worker.Worker is a remote µdensity: it leases tasks from the main instance,
+runs them with its own run.Runner, then sends back their volumes and their outcome.
+The main instance's storage stays the reference.
+*/
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/factorysh/microdensity/conf"
+	"github.com/factorysh/microdensity/queue"
+	"github.com/factorysh/microdensity/run"
+	"github.com/factorysh/microdensity/task"
+	"github.com/factorysh/microdensity/volumes"
+	"go.uber.org/zap"
+)
+
+// Registration is sent by a worker when it starts
+type Registration struct {
+	Slots int `json:"slots"`
+}
+
+// Worker runs the tasks leased from the main instance
+type Worker struct {
+	server  string
+	name    string
+	token   string
+	slots   int
+	poll    time.Duration
+	client  *http.Client
+	runner  *run.Runner
+	volumes *volumes.Volumes
+	logger  *zap.Logger
+}
+
+// New worker, from the worker section of the conf
+func New(cfg *conf.Conf) (*Worker, error) {
+	if cfg.Worker.Server == "" || cfg.Worker.Name == "" || cfg.Worker.Token == "" {
+		return nil, errors.New("worker requires a server, a name and a token")
+	}
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return nil, err
+	}
+	runner, err := run.NewRunner(cfg.Services, cfg.DataPath, cfg.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	v, err := volumes.New(cfg.DataPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Worker{
+		server:  strings.TrimSuffix(cfg.Worker.Server, "/"),
+		name:    cfg.Worker.Name,
+		token:   cfg.Worker.Token,
+		slots:   cfg.Worker.Slots,
+		poll:    cfg.Worker.Poll,
+		client:  &http.Client{},
+		runner:  runner,
+		volumes: v,
+		logger:  logger.With(zap.String("worker", cfg.Worker.Name)),
+	}, nil
+}
+
+// Run registers the worker, then leases tasks until the context is done.
+// Running tasks end before it returns.
+func (w *Worker) Run(ctx context.Context) error {
+	err := w.register(ctx)
+	if err != nil {
+		return err
+	}
+	w.logger.Info("Worker registered", zap.String("server", w.server), zap.Int("slots", w.slots))
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// loop leases and runs one task at a time, it waits when the queue is empty
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		l, err := w.lease(ctx)
+		if err != nil {
+			w.logger.Error("Lease error", zap.Error(err))
+		}
+		if l == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(w.poll):
+			}
+			continue
+		}
+		w.run(l)
+	}
+}
+
+// run a leased task, then send its volumes and its outcome
+func (w *Worker) run(l *queue.Lease) {
+	t := l.Task
+	logger := w.logger.With(zap.String("id", t.Id.String()), zap.String("service", t.Service))
+	logger.Info("Run leased task")
+
+	var result queue.Result
+	err := w.runner.WriteInputs(t, l.Files)
+	if err != nil {
+		logger.Error("Inputs error", zap.Error(err))
+		result.Error = err.Error()
+		w.end(t, result, logger)
+		return
+	}
+	_, err = w.runner.Prepare(t, l.Env, run.Options{
+		Timeout:       l.Timeout,
+		Limits:        l.Limits,
+		Network:       l.Network,
+		KeepOnFailure: l.KeepOnFailure,
+		Container:     l.Container,
+	})
+	if err != nil {
+		logger.Error("Prepare error", zap.Error(err))
+		result.Error = err.Error()
+		w.end(t, result, logger)
+		return
+	}
+
+	stop := make(chan bool)
+	go w.renew(t, time.Until(l.Expires), stop, logger)
+
+	ret, err := w.runner.Run(t)
+	result.ExitCode = ret
+	if errors.Is(err, run.ErrTimeout) {
+		result.TimedOut = true
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+
+	// the outcome is sent, even without its volumes or its logs
+	err = w.upload(t)
+	if err != nil {
+		logger.Error("Volumes upload error", zap.Error(err))
+	}
+	err = w.uploadLogs(t)
+	if err != nil {
+		logger.Error("Logs upload error", zap.Error(err))
+	}
+	close(stop)
+	w.end(t, result, logger)
+
+	err = os.RemoveAll(w.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String()))
+	if err != nil {
+		logger.Error("Volumes cleanup error", zap.Error(err))
+	}
+}
+
+// renew the lease until stop is closed, the run is canceled when the lease is lost
+func (w *Worker) renew(t *task.Task, lease time.Duration, stop chan bool, logger *zap.Logger) {
+	every := lease / 3
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		resp, err := w.do(context.Background(), http.MethodPost, fmt.Sprintf("/worker/tasks/%s/renew", t.Id), "", nil)
+		if err != nil {
+			// the server may come back before the end of the lease
+			logger.Warn("Renew error", zap.Error(err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			continue
+		}
+		logger.Warn("Lease lost, cancel the run", zap.Int("status", resp.StatusCode))
+		err = w.runner.Cancel(t)
+		if err != nil {
+			logger.Warn("Runner cancel", zap.Error(err))
+		}
+		return
+	}
+}
+
+// register the worker to the main instance
+func (w *Worker) register(ctx context.Context) error {
+	body, err := json.Marshal(Registration{Slots: w.slots})
+	if err != nil {
+		return err
+	}
+	resp, err := w.do(ctx, http.MethodPost, "/worker/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("register: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// lease the next task, nil if there is none
+func (w *Worker) lease(ctx context.Context) (*queue.Lease, error) {
+	resp, err := w.do(ctx, http.MethodPost, "/worker/lease", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var l queue.Lease
+		err = json.NewDecoder(resp.Body).Decode(&l)
+		if err != nil {
+			return nil, err
+		}
+		return &l, nil
+	default:
+		return nil, fmt.Errorf("lease: unexpected status %d", resp.StatusCode)
+	}
+}
+
+// upload the volumes of a task, as a gzipped tar
+func (w *Worker) upload(t *task.Task) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Tar(pw, w.volumes.Path(t.Service, t.Project, t.Branch, t.Id.String(), "volumes")))
+	}()
+	resp, err := w.do(context.Background(), http.MethodPut, fmt.Sprintf("/worker/tasks/%s/volumes", t.Id), "application/gzip", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("volumes: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// uploadLogs sends the logs file of a run
+func (w *Worker) uploadLogs(t *task.Task) error {
+	f, err := os.Open(w.runner.LogsPath(t))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := w.do(context.Background(), http.MethodPut, fmt.Sprintf("/worker/tasks/%s/logs", t.Id), "application/x-ndjson", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("logs: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// end sends the outcome of a run
+func (w *Worker) end(t *task.Task, result queue.Result, logger *zap.Logger) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("Result encoding error", zap.Error(err))
+		return
+	}
+	resp, err := w.do(context.Background(), http.MethodPost, fmt.Sprintf("/worker/tasks/%s/end", t.Id), "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("End error", zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		// the lease expired, the task runs again elsewhere
+		logger.Warn("End refused", zap.Int("status", resp.StatusCode))
+		return
+	}
+	logger.Info("Task ended", zap.Int("exit code", result.ExitCode))
+}
+
+// do an authenticated request to the main instance
+func (w *Worker) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return w.client.Do(req)
+}